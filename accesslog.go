@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// Access log in the formats alp understands by default:
+//
+//	alp ltsv --file access.log
+//	alp json --file access.log
+//
+// reqtime is the whole request, apptime ends when the handler writes the
+// response header, like upstream_response_time behind nginx. The file is
+// reopened on SIGHUP so it can be rotated with logrotate.
+
+const (
+	accessLogLTSV = "ltsv"
+	accessLogJSON = "json"
+)
+
+type accessLogger struct {
+	sync.Mutex
+	path   string
+	format string
+	f      *os.File
+}
+
+var accessLog *accessLogger
+
+// openAccessLog starts writing the access log to path. An empty path
+// disables it.
+func openAccessLog(path, format string) error {
+	if path == "" {
+		return nil
+	}
+	if format != accessLogJSON {
+		format = accessLogLTSV
+	}
+	al := &accessLogger{path: path, format: format}
+	if err := al.reopen(); err != nil {
+		return err
+	}
+	accessLog = al
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := al.reopen(); err != nil {
+				slog.Error("failed to reopen access log", "path", path, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (al *accessLogger) reopen() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	al.Lock()
+	old := al.f
+	al.f = f
+	al.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+type accessLogEntry struct {
+	Time         time.Time
+	RemoteAddr   string
+	ForwardedFor string
+	Method       string
+	URI          string
+	Route        string
+	Status       int
+	Size         int
+	ReqTime      time.Duration
+	AppTime      time.Duration
+	UserAgent    string
+	RequestID    string
+}
+
+// ltsvEscaper keeps client-supplied values, such as the URI and user agent,
+// from splitting a field or a line.
+var ltsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (e *accessLogEntry) ltsv() []byte {
+	var b bytes.Buffer
+	field := func(k, v string) {
+		if b.Len() > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		if v == "" {
+			v = "-"
+		}
+		ltsvEscaper.WriteString(&b, v)
+	}
+	field("time", e.Time.Format(time.RFC3339))
+	field("host", e.RemoteAddr)
+	field("forwardedfor", e.ForwardedFor)
+	field("method", e.Method)
+	field("uri", e.URI)
+	field("route", e.Route)
+	field("status", strconv.Itoa(e.Status))
+	field("size", strconv.Itoa(e.Size))
+	field("reqtime", strconv.FormatFloat(e.ReqTime.Seconds(), 'f', 6, 64))
+	field("apptime", strconv.FormatFloat(e.AppTime.Seconds(), 'f', 6, 64))
+	field("ua", e.UserAgent)
+	field("req_id", e.RequestID)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (e *accessLogEntry) json() []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"time":          e.Time.Format(time.RFC3339),
+		"host":          e.RemoteAddr,
+		"forwardedfor":  e.ForwardedFor,
+		"method":        e.Method,
+		"uri":           e.URI,
+		"route":         e.Route,
+		"status":        e.Status,
+		"body_bytes":    e.Size,
+		"request_time":  e.ReqTime.Seconds(),
+		"response_time": e.AppTime.Seconds(),
+		"user_agent":    e.UserAgent,
+		"req_id":        e.RequestID,
+	})
+	return append(b, '\n')
+}
+
+func (al *accessLogger) write(e *accessLogEntry) {
+	var line []byte
+	if al.format == accessLogJSON {
+		line = e.json()
+	} else {
+		line = e.ltsv()
+	}
+	al.Lock()
+	_, err := al.f.Write(line)
+	al.Unlock()
+	if err != nil {
+		slog.Error("failed to write access log", "err", err)
+	}
+}
+
+// headerTimer records when the response header is written. It passes on
+// the optional interfaces of the writer it wraps, so that streaming,
+// sendfile and hijacking keep working behind the access log.
+type headerTimer struct {
+	mutil.WriterProxy
+	wroteAt time.Time
+}
+
+func (t *headerTimer) stamp() {
+	if t.wroteAt.IsZero() {
+		t.wroteAt = time.Now()
+	}
+}
+
+func (t *headerTimer) WriteHeader(code int) {
+	t.stamp()
+	t.WriterProxy.WriteHeader(code)
+}
+
+func (t *headerTimer) Write(b []byte) (int, error) {
+	t.stamp()
+	return t.WriterProxy.Write(b)
+}
+
+func (t *headerTimer) ReadFrom(r io.Reader) (int64, error) {
+	t.stamp()
+	if rf, ok := t.WriterProxy.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{t.WriterProxy}, r)
+}
+
+func (t *headerTimer) Flush() {
+	t.stamp()
+	if f, ok := t.WriterProxy.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *headerTimer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := t.WriterProxy.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("accesslog: connection does not support hijacking")
+	}
+	t.stamp()
+	return hj.Hijack()
+}
+
+func accessLogMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if accessLog == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ww := &headerTimer{WriterProxy: mutil.WrapWriter(w)}
+		h.ServeHTTP(ww, r)
+		end := time.Now()
+
+		if ww.wroteAt.IsZero() {
+			ww.wroteAt = end
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		accessLog.write(&accessLogEntry{
+			Time:         start,
+			RemoteAddr:   r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Method:       r.Method,
+			URI:          r.RequestURI,
+			Route:        routePattern(c),
+			Status:       status,
+			Size:         ww.BytesWritten(),
+			ReqTime:      end.Sub(start),
+			AppTime:      ww.wroteAt.Sub(start),
+			UserAgent:    r.UserAgent(),
+			RequestID:    w.Header().Get(requestIDHeader),
+		})
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ActivityPub federation for public accounts.
+//
+// Every local user is exposed as a Person at /users/:accountName. All actors
+// share the instance key (config.APKey), published as "<actor>#main-key".
+// Remote accounts that comment on local posts are stored in `users` with
+// account_name "name@host" and an empty passhash, so they can never log in.
+
+const (
+	activityContentType = "application/activity+json"
+	activityStreams     = "https://www.w3.org/ns/activitystreams"
+	activityPublic      = "https://www.w3.org/ns/activitystreams#Public"
+	activityInboxLimit  = 1 << 20
+)
+
+var (
+	apKey *rsa.PrivateKey
+	// apInsecure allows federating over plain http, for running two local
+	// instances against each other.
+	apInsecure bool
+
+	apClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: apCheckDial}).DialContext,
+		},
+	}
+
+	apPostPathRegexp = regexp.MustCompile(`\A/posts/(\d+)\z`)
+	apTagRegexp      = regexp.MustCompile(`<[^>]*>`)
+
+	errNotFollowing = errors.New("activitypub: not following")
+)
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apActor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name,omitempty"`
+	URL               string      `json:"url,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox,omitempty"`
+	Followers         string      `json:"followers,omitempty"`
+	Published         string      `json:"published,omitempty"`
+	PublicKey         apPublicKey `json:"publicKey"`
+	Endpoints         struct {
+		SharedInbox string `json:"sharedInbox,omitempty"`
+	} `json:"endpoints"`
+}
+
+type apAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+}
+
+type apNote struct {
+	Context      interface{}    `json:"@context,omitempty"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	AttributedTo string         `json:"attributedTo"`
+	InReplyTo    string         `json:"inReplyTo,omitempty"`
+	Content      string         `json:"content"`
+	URL          string         `json:"url,omitempty"`
+	Published    string         `json:"published"`
+	To           []string       `json:"to,omitempty"`
+	Cc           []string       `json:"cc,omitempty"`
+	Attachment   []apAttachment `json:"attachment,omitempty"`
+}
+
+type apActivity struct {
+	Context interface{}     `json:"@context,omitempty"`
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Actor   string          `json:"actor"`
+	Object  json.RawMessage `json:"object"`
+	To      []string        `json:"to,omitempty"`
+	Cc      []string        `json:"cc,omitempty"`
+}
+
+// objectID returns the id of an object that is either embedded or a bare IRI.
+func (a *apActivity) objectID() string {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		return id
+	}
+	var o struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(a.Object, &o)
+	return o.ID
+}
+
+type apCollection struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webfinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webfingerLink `json:"links"`
+}
+
+func apInit() {
+	keyPath := config.APKey
+	apInsecure = config.APInsecure
+
+	var err error
+	apKey, err = loadOrCreateKey(keyPath)
+	if err != nil {
+		fatal("Failed to load ActivityPub key.", "path", keyPath, "err", err)
+	}
+}
+
+func apActorURL(r *http.Request, accountName string) string {
+	return absoluteURL(r, "/users/"+accountName)
+}
+
+func apPostURL(r *http.Request, pid int) string {
+	return absoluteURL(r, "/posts/"+strconv.Itoa(pid))
+}
+
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, activityContentType) ||
+		strings.Contains(accept, "application/ld+json")
+}
+
+func writeActivityJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", activityContentType+"; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write activity", "err", err)
+	}
+}
+
+// getLocalUser looks up a public, non-banned local account.
+func getLocalUser(ctx context.Context, accountName string) (User, bool) {
+	user := User{}
+	if strings.Contains(accountName, "@") {
+		return user, false
+	}
+	err := db.GetContext(ctx, &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	return user, err == nil
+}
+
+func apNoteOf(r *http.Request, p *Post) apNote {
+	actor := apActorURL(r, p.User.AccountName)
+	return apNote{
+		ID:           apPostURL(r, p.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      "<p>" + strings.Replace(html.EscapeString(p.Body), "\n", "<br>", -1) + "</p>",
+		URL:          apPostURL(r, p.ID),
+		Published:    p.CreatedAt.UTC().Format(time.RFC3339),
+		To:           []string{activityPublic},
+		Cc:           []string{actor + "/followers"},
+		Attachment: []apAttachment{{
+			Type:      "Document",
+			MediaType: p.Mime,
+			URL:       absoluteURL(r, imageURL(p)),
+		}},
+	}
+}
+
+func apCreateOf(r *http.Request, p *Post) apActivity {
+	note := apNoteOf(r, p)
+	obj, _ := json.Marshal(note)
+	return apActivity{
+		ID:     note.ID + "/activity",
+		Type:   "Create",
+		Actor:  note.AttributedTo,
+		Object: obj,
+		To:     note.To,
+		Cc:     note.Cc,
+	}
+}
+
+func getWebfinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if !strings.HasPrefix(resource, "acct:") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	accountName := strings.TrimPrefix(resource, "acct:")
+	if i := strings.IndexByte(accountName, '@'); i >= 0 {
+		if accountName[i+1:] != r.Host {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		accountName = accountName[:i]
+	}
+	user, ok := getLocalUser(r.Context(), accountName)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json; charset=utf-8")
+	json.NewEncoder(w).Encode(webfinger{
+		Subject: "acct:" + user.AccountName + "@" + r.Host,
+		Aliases: []string{apActorURL(r, user.AccountName), absoluteURL(r, "/@"+user.AccountName)},
+		Links: []webfingerLink{
+			{Rel: "self", Type: activityContentType, Href: apActorURL(r, user.AccountName)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: absoluteURL(r, "/@"+user.AccountName)},
+		},
+	})
+}
+
+func getActor(c web.C, w http.ResponseWriter, r *http.Request) {
+	user, ok := getLocalUser(r.Context(), c.URLParams["accountName"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := apActorURL(r, user.AccountName)
+	actor := apActor{
+		Context:           []string{activityStreams, "https://w3id.org/security/v1"},
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: user.AccountName,
+		Name:              user.AccountName,
+		URL:               absoluteURL(r, "/@"+user.AccountName),
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Published:         user.CreatedAt.UTC().Format(time.RFC3339),
+		PublicKey: apPublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: publicKeyPEM(apKey),
+		},
+	}
+	writeActivityJSON(w, actor)
+}
+
+func getOutbox(c web.C, w http.ResponseWriter, r *http.Request) {
+	user, ok := getLocalUser(r.Context(), c.URLParams["accountName"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	results := []Post{}
+	err := db.SelectContext(r.Context(), &results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, config.PostsPerPage)
+	if err != nil {
+		reqLogger(r).Error("failed to select outbox posts", "user_id", user.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	postCount := 0
+	if err := db.GetContext(r.Context(), &postCount, "SELECT COUNT(*) FROM `posts` WHERE `user_id` = ?", user.ID); err != nil {
+		reqLogger(r).Error("failed to count posts", "user_id", user.ID, "err", err)
+	}
+
+	outbox := apCollection{
+		Context:    activityStreams,
+		ID:         apActorURL(r, user.AccountName) + "/outbox",
+		Type:       "OrderedCollection",
+		TotalItems: postCount,
+	}
+	for i := range results {
+		results[i].User = user
+		outbox.OrderedItems = append(outbox.OrderedItems, apCreateOf(r, &results[i]))
+	}
+	writeActivityJSON(w, outbox)
+}
+
+func getFollowers(c web.C, w http.ResponseWriter, r *http.Request) {
+	user, ok := getLocalUser(r.Context(), c.URLParams["accountName"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	count := 0
+	if err := db.GetContext(r.Context(), &count, "SELECT COUNT(*) FROM `ap_followers` WHERE `user_id` = ?", user.ID); err != nil {
+		reqLogger(r).Error("failed to count followers", "user_id", user.ID, "err", err)
+	}
+	writeActivityJSON(w, apCollection{
+		Context:    activityStreams,
+		ID:         apActorURL(r, user.AccountName) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: count,
+	})
+}
+
+// getPostNote serves the Note for /posts/:id to ActivityPub clients.
+func getPostNote(w http.ResponseWriter, r *http.Request, p *Post) {
+	note := apNoteOf(r, p)
+	note.Context = activityStreams
+	writeActivityJSON(w, note)
+}
+
+func apGet(iri string, v interface{}) error {
+	u, err := url.Parse(iri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && !(apInsecure && u.Scheme == "http") {
+		return fmt.Errorf("activitypub: refusing to fetch %s", iri)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", activityContentType)
+	res, err := apClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("activitypub: GET %s: %s", iri, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, activityInboxLimit)).Decode(v)
+}
+
+// apDeliver posts a signed activity to a remote inbox.
+func apDeliver(inbox, keyID string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	if err := signRequest(req, keyID, apKey, body); err != nil {
+		return err
+	}
+	res, err := apClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("activitypub: POST %s: %s", inbox, res.Status)
+	}
+	return nil
+}
+
+// apDeliverPost sends a Create for a new post to all followers of its author.
+func apDeliverPost(r *http.Request, p Post) {
+	inboxes := []string{}
+	err := db.SelectContext(r.Context(), &inboxes, "SELECT DISTINCT `inbox` FROM `ap_followers` WHERE `user_id` = ?", p.UserID)
+	if err != nil {
+		reqLogger(r).Error("failed to select follower inboxes", "user_id", p.UserID, "err", err)
+		return
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+	activity := apCreateOf(r, &p)
+	activity.Context = activityStreams
+	keyID := apActorURL(r, p.User.AccountName) + "#main-key"
+	go func() {
+		for _, inbox := range inboxes {
+			if err := apDeliver(inbox, keyID, activity); err != nil {
+				slog.Warn("failed to deliver post", "post_id", p.ID, "inbox", inbox, "err", err)
+			}
+		}
+	}()
+}
+
+// apCheckDial refuses connections to loopback, private and link-local
+// addresses, since remote servers choose the URLs we fetch and deliver to.
+// apInsecure allows them, for local instances.
+func apCheckDial(network, address string, _ syscall.RawConn) error {
+	if apInsecure {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("activitypub: refusing to connect to %s", address)
+	}
+	return nil
+}
+
+// apLookupKey fetches the actor owning keyID and returns its public key.
+func apLookupKey(keyID string) (*apActor, *rsa.PublicKey, error) {
+	actorID := keyID
+	if i := strings.IndexByte(actorID, '#'); i >= 0 {
+		actorID = actorID[:i]
+	}
+	var actor apActor
+	if err := apGet(actorID, &actor); err != nil {
+		return nil, nil, err
+	}
+	// The document must describe itself and its own key; otherwise any
+	// server could claim to be any actor.
+	if actor.ID != actorID || actor.PublicKey.ID != keyID || actor.PublicKey.Owner != actor.ID {
+		return nil, nil, fmt.Errorf("activitypub: key %s not owned by %s", keyID, actorID)
+	}
+	key, err := parsePublicKeyPEM(actor.PublicKey.PublicKeyPem)
+	return &actor, key, err
+}
+
+// remoteUser returns the local shadow user for a remote actor, creating it
+// on first contact. Actors are matched by IRI in ap_actors; the account name
+// preferredUsername@host is only what the user is shown as, and gets a
+// suffix when another actor already has it.
+func remoteUser(ctx context.Context, actor *apActor) (User, error) {
+	var uid int
+	err := db.GetContext(ctx, &uid, "SELECT `user_id` FROM `ap_actors` WHERE `actor` = ?", actor.ID)
+	if err == nil {
+		return getUser(ctx, uid), nil
+	}
+	if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	u, err := url.Parse(actor.ID)
+	if err != nil {
+		return User{}, err
+	}
+	accountName := actor.PreferredUsername + "@" + u.Host
+
+	// Shadow users created before ap_actors existed are claimed by the
+	// first actor that shows up with their name.
+	user := User{}
+	err = db.GetContext(ctx, &user, "SELECT u.* FROM `users` u LEFT JOIN `ap_actors` a ON a.`user_id` = u.`id`"+
+		" WHERE u.`account_name` = ? AND u.`passhash` = '' AND a.`actor` IS NULL", accountName)
+	switch {
+	case err == sql.ErrNoRows:
+		var taken int
+		if err := db.GetContext(ctx, &taken, "SELECT COUNT(*) FROM `users` WHERE `account_name` = ?", accountName); err != nil {
+			return User{}, err
+		}
+		if taken > 0 {
+			sum := sha256.Sum256([]byte(actor.ID))
+			suffix := fmt.Sprintf("#%x", sum[:4])
+			accountName = accountName[:min(len(accountName), 64-len(suffix))] + suffix
+		}
+		if user, err = insertUser(ctx, User{AccountName: accountName}); err != nil {
+			return User{}, err
+		}
+	case err != nil:
+		return User{}, err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO `ap_actors` (`actor`, `user_id`) VALUES (?,?)", actor.ID, user.ID)
+	return user, err
+}
+
+// firstDelivery records the ID of an inbox activity and reports whether it
+// was new. IDs are kept for twice signatureMaxSkew, the longest a signed
+// request is accepted, so a replayed delivery is always caught.
+func firstDelivery(ctx context.Context, id string) (bool, error) {
+	if _, err := db.ExecContext(ctx, "DELETE FROM `ap_activities` WHERE `created_at` < ?", time.Now().Add(-2*signatureMaxSkew)); err != nil {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx, "INSERT IGNORE INTO `ap_activities` (`id`) VALUES (?)", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func postInbox(c web.C, w http.ResponseWriter, r *http.Request) {
+	user, ok := getLocalUser(r.Context(), c.URLParams["accountName"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, activityInboxLimit))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var actor *apActor
+	_, err = verifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+		a, key, err := apLookupKey(keyID)
+		actor = a
+		return key, err
+	})
+	if err != nil {
+		reqLogger(r).Warn("inbox signature rejected", "err", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var activity apActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if activity.Actor != actor.ID {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if activity.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	first, err := firstDelivery(r.Context(), activity.ID)
+	if err != nil {
+		reqLogger(r).Error("failed to record inbox activity", "id", activity.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !first {
+		// Already processed: a retry or a replay, accepted and ignored.
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		err = apHandleFollow(r, user, actor, &activity)
+	case "Undo":
+		err = apHandleUndo(r, user, actor, &activity)
+	case "Accept":
+		_, err = db.ExecContext(r.Context(), "UPDATE `ap_following` SET `accepted` = 1 WHERE `user_id` = ? AND `actor` = ?", user.ID, actor.ID)
+	case "Create":
+		err = apHandleCreate(r, actor, &activity)
+	}
+	if err != nil {
+		reqLogger(r).Warn("inbox activity rejected", "type", activity.Type, "actor", activity.Actor, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func apHandleFollow(r *http.Request, user User, actor *apActor, activity *apActivity) error {
+	if activity.objectID() != apActorURL(r, user.AccountName) {
+		return fmt.Errorf("activitypub: Follow of %s delivered to %s", activity.objectID(), user.AccountName)
+	}
+	inbox := actor.Inbox
+	if actor.Endpoints.SharedInbox != "" {
+		inbox = actor.Endpoints.SharedInbox
+	}
+	_, err := db.ExecContext(r.Context(), "INSERT INTO `ap_followers` (`user_id`, `actor`, `inbox`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `inbox` = VALUES(`inbox`)",
+		user.ID, actor.ID, inbox)
+	if err != nil {
+		return err
+	}
+
+	self := apActorURL(r, user.AccountName)
+	obj, _ := json.Marshal(activity)
+	accept := apActivity{
+		Context: activityStreams,
+		ID:      self + "#accepts/" + secureRandomStr(8),
+		Type:    "Accept",
+		Actor:   self,
+		Object:  obj,
+	}
+	go func() {
+		if err := apDeliver(actor.Inbox, self+"#main-key", accept); err != nil {
+			slog.Warn("failed to deliver accept", "inbox", actor.Inbox, "err", err)
+		}
+	}()
+	return nil
+}
+
+func apHandleUndo(r *http.Request, user User, actor *apActor, activity *apActivity) error {
+	var obj apActivity
+	if json.Unmarshal(activity.Object, &obj) == nil && obj.Type != "" && obj.Type != "Follow" {
+		// Undo of something we never stored.
+		return nil
+	}
+	_, err := db.ExecContext(r.Context(), "DELETE FROM `ap_followers` WHERE `user_id` = ? AND `actor` = ?", user.ID, actor.ID)
+	return err
+}
+
+// apHandleCreate stores replies to local posts as comments. Other objects
+// are accepted and ignored.
+func apHandleCreate(r *http.Request, actor *apActor, activity *apActivity) error {
+	var note apNote
+	if err := json.Unmarshal(activity.Object, &note); err != nil {
+		// The object is only an IRI; nothing to store.
+		return nil
+	}
+	if note.Type != "Note" || note.InReplyTo == "" {
+		return nil
+	}
+	if note.AttributedTo != actor.ID {
+		return fmt.Errorf("activitypub: %s is not attributed to %s", note.ID, actor.ID)
+	}
+	u, err := url.Parse(note.InReplyTo)
+	if err != nil || u.Host != r.Host {
+		return nil
+	}
+	m := apPostPathRegexp.FindStringSubmatch(u.Path)
+	if m == nil {
+		return nil
+	}
+	postID, _ := strconv.Atoi(m[1])
+	exists := 0
+	if err := db.GetContext(r.Context(), &exists, "SELECT 1 FROM `posts` WHERE `id` = ?", postID); err != nil {
+		return nil
+	}
+
+	commenter, err := remoteUser(r.Context(), actor)
+	if err != nil {
+		return err
+	}
+	if commenter.DelFlg == 1 {
+		return nil
+	}
+
+	c := Comment{
+		PostID:    postID,
+		UserID:    commenter.ID,
+		Comment:   strings.TrimSpace(html.UnescapeString(apTagRegexp.ReplaceAllString(note.Content, ""))),
+		CreatedAt: time.Now(),
+		User:      commenter,
+	}
+	c.ID, err = insertComment(r.Context(), c)
+	if err != nil {
+		return err
+	}
+	// The comment is stored; update the caches even if the sender has gone.
+	ctx := context.WithoutCancel(r.Context())
+	appendComent(ctx, c)
+	refreshIndex(ctx)
+	return nil
+}
+
+// apResolveAccount resolves "name@host" through WebFinger to an actor.
+func apResolveAccount(account string) (*apActor, error) {
+	account = strings.TrimPrefix(account, "@")
+	i := strings.IndexByte(account, '@')
+	if i <= 0 {
+		return nil, fmt.Errorf("activitypub: bad account %q", account)
+	}
+	host := account[i+1:]
+	scheme := "https"
+	if apInsecure {
+		scheme = "http"
+	}
+	res, err := apClient.Get(scheme + "://" + host + "/.well-known/webfinger?resource=" + url.QueryEscape("acct:"+account))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("activitypub: webfinger %s: %s", account, res.Status)
+	}
+	var wf webfinger
+	if err := json.NewDecoder(io.LimitReader(res.Body, activityInboxLimit)).Decode(&wf); err != nil {
+		return nil, err
+	}
+	for _, l := range wf.Links {
+		if l.Rel == "self" && strings.HasPrefix(l.Type, "application/") {
+			var actor apActor
+			if err := apGet(l.Href, &actor); err != nil {
+				return nil, err
+			}
+			return &actor, nil
+		}
+	}
+	return nil, fmt.Errorf("activitypub: no actor for %s", account)
+}
+
+func apFollowActivity(r *http.Request, me User, actorID string) apActivity {
+	self := apActorURL(r, me.AccountName)
+	obj, _ := json.Marshal(actorID)
+	return apActivity{
+		Context: activityStreams,
+		ID:      self + "#follows/" + url.PathEscape(actorID),
+		Type:    "Follow",
+		Actor:   self,
+		Object:  obj,
+	}
+}
+
+// postFollow lets a local user follow a remote account given as name@host.
+func postFollow(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	actor, err := apResolveAccount(r.FormValue("account"))
+	if err != nil {
+		reqLogger(r).Warn("failed to resolve account", "account", r.FormValue("account"), "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, err = db.ExecContext(r.Context(), "INSERT INTO `ap_following` (`user_id`, `actor`, `inbox`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `inbox` = VALUES(`inbox`)",
+		me.ID, actor.ID, actor.Inbox)
+	if err != nil {
+		reqLogger(r).Error("failed to insert following", "actor", actor.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	self := apActorURL(r, me.AccountName)
+	if err := apDeliver(actor.Inbox, self+"#main-key", apFollowActivity(r, me, actor.ID)); err != nil {
+		reqLogger(r).Warn("failed to deliver follow", "inbox", actor.Inbox, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, "/@"+me.AccountName, http.StatusFound)
+}
+
+// postUnfollow undoes a previous postFollow.
+func postUnfollow(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+
+	actor, err := apResolveAccount(r.FormValue("account"))
+	if err != nil {
+		reqLogger(r).Warn("failed to resolve account", "account", r.FormValue("account"), "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM `ap_following` WHERE `user_id` = ? AND `actor` = ?", me.ID, actor.ID)
+	if err != nil {
+		reqLogger(r).Error("failed to delete following", "actor", actor.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		reqLogger(r).Warn("unfollow rejected", "actor", actor.ID, "err", errNotFollowing)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	self := apActorURL(r, me.AccountName)
+	follow, _ := json.Marshal(apFollowActivity(r, me, actor.ID))
+	undo := apActivity{
+		Context: activityStreams,
+		ID:      self + "#undo/" + secureRandomStr(8),
+		Type:    "Undo",
+		Actor:   self,
+		Object:  follow,
+	}
+	if err := apDeliver(actor.Inbox, self+"#main-key", undo); err != nil {
+		reqLogger(r).Warn("failed to deliver undo", "inbox", actor.Inbox, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, "/@"+me.AccountName, http.StatusFound)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The debug listener serves pprof and the admin endpoints used by the
+// command line. It binds to localhost by default; when admin_token is set,
+// every request must also carry it as a bearer token.
+
+// isLoopbackAddr reports whether addr listens on loopback only.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func setAdminToken(r *http.Request) {
+	if config.AdminToken != "" {
+		r.Header.Set("Authorization", "Bearer "+config.AdminToken)
+	}
+}
+
+func validAdminToken(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// requireAdmin rejects requests without the admin token.
+func requireAdmin(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !validAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="isucon-admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
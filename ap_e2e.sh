@@ -0,0 +1,78 @@
+#!/bin/bash
+# Federate two local instances: alice on A follows bob on B, unfollows, and
+# comments on one of bob's posts.
+# Needs two databases with the isuconp schema, named by DB_A and DB_B.
+set -eu
+
+DB_A=${DB_A:-isuconp}
+DB_B=${DB_B:-isuconp2}
+A=localhost:8080
+B=localhost:8081
+TMP=$(mktemp -d)
+trap 'kill $(jobs -p) 2>/dev/null; rm -rf $TMP' EXIT
+
+go generate && go build -o app .
+ISUCONP_DB_NAME=$DB_A ./app migrate
+ISUCONP_DB_NAME=$DB_B ./app migrate
+
+ISUCONP_DB_NAME=$DB_A ISUCONP_AP_KEY=$TMP/a.pem ISUCONP_AP_INSECURE=1 ./app -bind :8080 &
+ISUCONP_DB_NAME=$DB_B ISUCONP_AP_KEY=$TMP/b.pem ISUCONP_AP_INSECURE=1 ./app -bind :8081 &
+sleep 2
+
+register() {
+	curl -s -o /dev/null -c $TMP/$1.jar -d "account_name=$1&password=password" http://$2/register
+	curl -s -o /dev/null -b $TMP/$1.jar -c $TMP/$1.jar -d "account_name=$1&password=password" http://$2/login
+}
+
+followers() {
+	curl -s -H 'Accept: application/activity+json' http://$B/users/bob/followers | grep -o '"totalItems":[0-9]*'
+}
+
+register alice $A
+register bob $B
+
+curl -s -f http://$B/.well-known/webfinger?resource=acct:bob@$B >/dev/null
+curl -s -f -H 'Accept: application/activity+json' http://$B/users/bob >/dev/null
+
+curl -s -f -o /dev/null -b $TMP/alice.jar -d "account=bob@$B&csrf_token=DEADBEEF" http://$A/follow
+test "$(followers)" = '"totalItems":1'
+echo "follow: ok"
+
+curl -s -f -o /dev/null -b $TMP/alice.jar -d "account=bob@$B&csrf_token=DEADBEEF" http://$A/unfollow
+test "$(followers)" = '"totalItems":0'
+echo "unfollow: ok"
+
+# alice on A replies to a post of bob's on B with a Create signed by A's key.
+printf 'GIF89a' > $TMP/img.gif
+curl -s -f -o /dev/null -b $TMP/bob.jar -F "file=@$TMP/img.gif;type=image/gif" -F body=hello -F csrf_token=DEADBEEF http://$B/
+PID=$(curl -s http://$B/ | grep -o 'id="pid_[0-9]*"' | head -1 | grep -o '[0-9]*')
+ACTOR=http://$A/users/alice
+BODY=$(printf '{"@context":"https://www.w3.org/ns/activitystreams","id":"%s/replies/1","type":"Create","actor":"%s","object":{"id":"%s/notes/1","type":"Note","attributedTo":"%s","inReplyTo":"http://%s/posts/%s","content":"<p>hi from A</p>"}}' \
+	"$ACTOR" "$ACTOR" "$ACTOR" "$ACTOR" "$B" "$PID")
+DATE=$(LC_ALL=C date -u '+%a, %d %b %Y %H:%M:%S GMT')
+DIGEST="SHA-256=$(printf '%s' "$BODY" | openssl dgst -sha256 -binary | base64 -w0)"
+SIGNED=$(printf '(request-target): post /users/bob/inbox\nhost: %s\ndate: %s\ndigest: %s' "$B" "$DATE" "$DIGEST")
+SIG=$(printf '%s' "$SIGNED" | openssl dgst -sha256 -sign $TMP/a.pem | base64 -w0)
+curl -s -f -o /dev/null -H 'Content-Type: application/activity+json' -H "Date: $DATE" -H "Digest: $DIGEST" \
+	-H "Signature: keyId=\"$ACTOR#main-key\",algorithm=\"rsa-sha256\",headers=\"(request-target) host date digest\",signature=\"$SIG\"" \
+	--data-binary "$BODY" http://$B/users/bob/inbox
+curl -s http://$B/posts/$PID | grep -q 'hi from A'
+curl -s http://$B/posts/$PID | grep -q "alice@$A"
+echo "create comment: ok"
+
+# Replaying the captured request is accepted but not processed again.
+CODE=$(curl -s -o /dev/null -w '%{http_code}' -H 'Content-Type: application/activity+json' -H "Date: $DATE" -H "Digest: $DIGEST" \
+	-H "Signature: keyId=\"$ACTOR#main-key\",algorithm=\"rsa-sha256\",headers=\"(request-target) host date digest\",signature=\"$SIG\"" \
+	--data-binary "$BODY" http://$B/users/bob/inbox)
+test "$CODE" = 202
+test "$(curl -s http://$B/posts/$PID | grep -c 'hi from A')" = 1
+echo "replayed activity ignored: ok"
+
+# The same request with Date left out of the signature is refused.
+SIGNED=$(printf '(request-target): post /users/bob/inbox\nhost: %s\ndigest: %s' "$B" "$DIGEST")
+SIG=$(printf '%s' "$SIGNED" | openssl dgst -sha256 -sign $TMP/a.pem | base64 -w0)
+CODE=$(curl -s -o /dev/null -w '%{http_code}' -H 'Content-Type: application/activity+json' -H "Date: $DATE" -H "Digest: $DIGEST" \
+	-H "Signature: keyId=\"$ACTOR#main-key\",algorithm=\"rsa-sha256\",headers=\"(request-target) host digest\",signature=\"$SIG\"" \
+	--data-binary "$BODY" http://$B/users/bob/inbox)
+test "$CODE" = 401
+echo "unsigned date rejected: ok"
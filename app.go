@@ -2,34 +2,32 @@ package main
 
 import (
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
-	"flag"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"net/url"
 	"os"
-	"path"
 	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/bind"
+	"github.com/zenazn/goji/graceful"
 	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
 )
 
 var (
@@ -38,9 +36,7 @@ var (
 
 const (
 	csrfToken      = "DEADBEEF"
-	postsPerPage   = 20
 	ISO8601_FORMAT = "2006-01-02T15:04:05-07:00"
-	UploadLimit    = 10 * 1024 * 1024 // 10mb
 
 	// CSRF Token error
 	StatusUnprocessableEntity = 422
@@ -52,6 +48,7 @@ type User struct {
 	Passhash    string    `db:"passhash"`
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
+	Locale      string    `db:"locale"`
 	CreatedAt   time.Time `db:"created_at"`
 }
 
@@ -68,10 +65,6 @@ type Post struct {
 	CSRFToken    string
 }
 
-func (p *Post) Render() template.HTML {
-	return template.HTML(PrintPost(p))
-}
-
 type Comment struct {
 	ID        int       `db:"id"`
 	PostID    int       `db:"post_id"`
@@ -81,42 +74,59 @@ type Comment struct {
 	User      User
 }
 
-func writeImage(id int, mime string, data []byte) {
-	fn := imagePath(id, mime)
-	err := ioutil.WriteFile(fn, data, 0666)
-	if err != nil {
-		log.Println("failed to write file; path=%q, err=%v", fn, err)
-	}
-}
-
-func copyImage(id int, src, mime string) {
+func copyImage(id int, src, mime string) (string, error) {
 	dst := imagePath(id, mime)
 	if err := os.Chmod(src, 0666); err != nil {
-		log.Println("failed to chmod: path=%v, %v", src, err)
+		slog.Error("failed to chmod", "path", src, "err", err)
 	}
-	if err := os.Rename(src, dst); err != nil {
-		log.Println("failed to rename; src=%q, dst=%q; %v", src, dst, err)
+	return dst, os.Rename(src, dst)
+}
+
+// openDB connects to the configured DB. It does not wait for it to answer.
+func openDB() error {
+	var err error
+	db, err = sqlx.Open(hookedDriverName, config.dsn())
+	if err != nil {
+		return err
 	}
+	db.SetMaxOpenConns(config.DBMaxOpenConns)
+	db.SetMaxIdleConns(config.DBMaxIdleConns)
+	return nil
 }
 
-func dbInitialize() {
+// dbInitialize restores the DB to the benchmark's initial data set. Callers
+// in the server must rebuildCaches afterwards.
+func dbInitialize(ctx context.Context) error {
 	sqls := []string{
 		"DELETE FROM users WHERE id > 1000",
+		"DELETE FROM ap_actors WHERE user_id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
 	}
 	for _, sql := range sqls {
-		db.Exec(sql)
+		if _, err := db.ExecContext(ctx, sql); err != nil {
+			return err
+		}
+	}
+	return recountUserStats(ctx)
+}
+
+// rebuildCaches reloads the users and drops the comments and user pages
+// cached in memory, then re-renders the index.
+func rebuildCaches(ctx context.Context) error {
+	if err := usersReset(ctx); err != nil {
+		return err
 	}
-	usersReset()
-	renderIndexPosts()
+	commentCache.reset()
+	profiles.reset()
+	return renderIndexPosts(ctx)
 }
 
-func tryLogin(accountName, password string) *User {
+func tryLogin(ctx context.Context, accountName, password string) *User {
 	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	err := db.GetContext(ctx, &u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
 	if err != nil {
 		return nil
 	}
@@ -160,7 +170,7 @@ func getSessionUser(r *http.Request) User {
 	if session.UserId == 0 {
 		return User{}
 	}
-	session.User = userGet(session.UserId)
+	session.User = getUser(r.Context(), session.UserId)
 	return session.User
 }
 
@@ -174,75 +184,38 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	return value
 }
 
-var (
-	commentM     sync.Mutex
-	commentStore map[int][]Comment = make(map[int][]Comment)
-)
-
-func getCommentsLocked(postID int) []Comment {
-	if cs, ok := commentStore[postID]; ok {
-		return cs
-	}
-
-	var cs []Comment
-	query := ("SELECT comments.id, comments.comment, comments.created_at, users.id, users.account_name " +
-		" FROM `comments` INNER JOIN users ON comments.user_id = users.id " +
-		" WHERE `post_id` = ? ORDER BY comments.`created_at`")
+func makePosts(ctx context.Context, results []Post, CSRFToken string, allComments bool, limit int) ([]Post, error) {
+	ctx, span := tracer.Start(ctx, "makePosts")
+	defer span.End()
 
-	rows, err := db.Query(query, postID)
-	if err != nil {
-		log.Println(err)
-		return cs
+	uids := make([]int, len(results))
+	for i, p := range results {
+		uids[i] = p.UserID
 	}
-	for rows.Next() {
-		var c Comment
-		err := rows.Scan(&c.ID, &c.Comment, &c.CreatedAt, &c.User.ID, &c.User.AccountName)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		cs = append(cs, c)
-	}
-	rows.Close()
-
-	commentStore[postID] = cs
-	return cs
-}
+	prefetchUsers(ctx, uids)
 
-func getComments(postID int) []Comment {
-	commentM.Lock()
-	defer commentM.Unlock()
-	return getCommentsLocked(postID)
-}
-
-func appendComent(c Comment) {
-	commentM.Lock()
-	cs := getCommentsLocked(c.PostID)
-	commentStore[c.PostID] = append(cs, c)
-	commentM.Unlock()
-}
-
-func makePosts(results []Post, CSRFToken string, allComments bool) ([]Post, error) {
 	var posts []Post
-
+	var postIDs []int
 	for _, p := range results {
-		comments := getComments(p.ID)
-		if !allComments && len(comments) > 3 {
-			comments = comments[len(comments)-3:]
-		}
-		p.Comments = comments
 		p.CSRFToken = CSRFToken
 
-		p.User = userGet(p.UserID)
+		p.User = getUser(ctx, p.UserID)
 		if p.User.DelFlg == 1 {
 			continue
 		}
 
 		posts = append(posts, p)
-		if len(posts) >= postsPerPage {
+		postIDs = append(postIDs, p.ID)
+		if len(posts) >= limit {
 			break
 		}
 	}
+
+	comments := loadComments(ctx, postIDs, allComments)
+	for i := range posts {
+		pc := comments[posts[i].ID]
+		posts[i].Comments, posts[i].CommentCount = pc.Comments, pc.Count
+	}
 	return posts, nil
 }
 
@@ -259,6 +232,29 @@ func imageURL(p *Post) string {
 	return "/image/" + strconv.Itoa(p.ID) + ext
 }
 
+// writePage renders p in the layout for me, in the locale of r.
+func writePage(w http.ResponseWriter, r *http.Request, name string, me User, p Page) {
+	renderPage(w, r, name, me, pageLocale(w, r, me), pageCSRFToken(w, r), p)
+}
+
+// renderPage renders p in the layout for me into a writer other than the
+// response, such as a buffer.
+func renderPage(w io.Writer, r *http.Request, name string, me User, loc locale, csrfToken string, p Page) {
+	traceRender(r.Context(), name, func() { views.writeLayout(w, name, me, loc, csrfToken, p) })
+}
+
+// pageCSRFToken returns the CSRF token for the forms of a page, giving the
+// session one first if it has none, as a visitor who has not logged in
+// does. It must be called before the response header is written.
+func pageCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	session := getSession(r)
+	if session.CsrfToken == "" {
+		session.CsrfToken = secureRandomStr(16)
+		session.Save(r, w)
+	}
+	return session.CsrfToken
+}
+
 func imagePath(id int, mime string) string {
 	var ext string
 	switch mime {
@@ -269,7 +265,7 @@ func imagePath(id int, mime string) string {
 	case "image/gif":
 		ext = ".gif"
 	}
-	return fmt.Sprintf("../public/image/%d%s", id, ext)
+	return fmt.Sprintf("%s/image/%d%s", config.PublicDir, id, ext)
 }
 
 func isLogin(u User) bool {
@@ -289,12 +285,17 @@ func secureRandomStr(b int) string {
 	return hex.EncodeToString(k)
 }
 
-func getTemplPath(filename string) string {
-	return path.Join("templates", filename)
-}
-
 func getInitialize(w http.ResponseWriter, r *http.Request) {
-	dbInitialize()
+	err := dbInitialize(r.Context())
+	if err == nil {
+		err = rebuildCaches(r.Context())
+	}
+	if err != nil {
+		reqLogger(r).Error("failed to initialize", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	publishInvalidation(r.Context(), invalidateAll, 0)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -305,16 +306,7 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := getSession(r)
-	if sess.Notice == "" {
-		w.Write(loginHTML)
-		return
-	}
-
-	loginTemplate.Execute(w, map[string]interface{}{
-		"Me":    me,
-		"Flash": sess.Notice,
-	})
+	writePage(w, r, "login", me, &LoginPage{Flash: getSession(r).Notice})
 }
 
 func postLogin(w http.ResponseWriter, r *http.Request) {
@@ -323,7 +315,7 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	u := tryLogin(r.Context(), r.FormValue("account_name"), r.FormValue("password"))
 	session := getSession(r)
 	if u != nil {
 		session.UserId = u.ID
@@ -331,7 +323,7 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
 	} else {
-		session.Notice = "アカウント名かパスワードが間違っています"
+		session.Notice = "login.failed"
 		session.Save(r, w)
 		http.Redirect(w, r, "/login", http.StatusFound)
 	}
@@ -343,13 +335,7 @@ func getRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("register.html")),
-	).Execute(w, struct {
-		Me    User
-		Flash string
-	}{User{}, getFlash(w, r, "notice")})
+	writePage(w, r, "register", User{}, &RegisterPage{Flash: getFlash(w, r, "notice")})
 }
 
 func postRegister(w http.ResponseWriter, r *http.Request) {
@@ -363,42 +349,29 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	validated := validateUser(accountName, password)
 	if !validated {
 		session := getSession(r)
-		session.Notice = "アカウント名は3文字以上、パスワードは6文字以上である必要があります"
+		session.Notice = "register.invalid"
 		session.Save(r, w)
 		http.Redirect(w, r, "/register", http.StatusFound)
 		return
 	}
 
-	exists := 0
-	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
-
-	if exists == 1 {
+	u, err := createUser(r.Context(), accountName, password, 0)
+	if err == errUserExists {
 		session := getSession(r)
-		session.Notice = "アカウント名がすでに使われています"
+		session.Notice = "register.taken"
 		session.Save(r, w)
 		http.Redirect(w, r, "/register", http.StatusFound)
 		return
 	}
-
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	passhash := calculatePasshash(accountName, password)
-	result, eerr := db.Exec(query, accountName, passhash)
-	if eerr != nil {
-		fmt.Println(eerr.Error())
+	if err != nil {
+		reqLogger(r).Error("failed to insert user", "err", err)
 		return
 	}
 
 	session := getSession(r)
-	uid, lerr := result.LastInsertId()
-	if lerr != nil {
-		fmt.Println(lerr.Error())
-		return
-	}
-	session.UserId = int(uid)
+	session.UserId = u.ID
 	session.CsrfToken = csrfToken
 	session.Save(r, w)
-	userAdd(User{ID: int(uid), AccountName: accountName, CreatedAt: time.Now(), Passhash: passhash})
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -411,198 +384,126 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 var (
-	indexTemplate       *template.Template
-	postsTemplate       *template.Template
-	accountNameTempalte *template.Template
-	loginTemplate       *template.Template
-	loginHTML           []byte
-	postIDTemplate      *template.Template
-
-	indexPostsM         sync.Mutex
-	indexPostsT         time.Time
-	indexPostsRenderedM sync.RWMutex
-	indexPostsRendered  template.HTML
+	indexPostsM          sync.Mutex
+	indexPostsT          time.Time
+	indexPostsRenderedM  sync.RWMutex
+	indexPostsRendered   map[locale]string
+	indexPostsCompressed map[locale]*precompressed
 )
 
-func init() {
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
-
-	indexTemplate = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("index.html"),
-	))
-
-	postsTemplate = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-
-	accountNameTempalte = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("user.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-
-	loginTemplate = template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("login.html")),
-	)
-	me := User{}
-	var buf bytes.Buffer
-	loginTemplate.Execute(&buf, struct {
-		Me    User
-		Flash string
-	}{me, ""})
-	loginHTML = buf.Bytes()
-
-	postIDTemplate = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("post_id.html"),
-		getTemplPath("post.html")))
-}
-
-func renderIndexPosts() {
+// renderIndexPosts renders the index post list unless it was rendered
+// since the call started. Failures are logged and returned.
+func renderIndexPosts(ctx context.Context) error {
 	now := time.Now()
 	indexPostsM.Lock()
 	defer indexPostsM.Unlock()
 	if indexPostsT.After(now) {
-		return
+		return nil
 	}
 	now = time.Now()
 
 	results := []Post{}
-	err := db.Select(&results, "SELECT posts.`id`, `user_id`, `body`, `mime`, posts.`created_at` FROM `posts` ORDER BY `created_at` DESC LIMIT 40")
+	err := db.SelectContext(ctx, &results, "SELECT posts.`id`, `user_id`, `body`, `mime`, posts.`created_at` FROM `posts` ORDER BY `created_at` DESC LIMIT 40")
 	if err != nil {
-		log.Println(err)
-		return
+		slog.Error("failed to select index posts", "err", err)
+		return err
 	}
 
-	posts, merr := makePosts(results, csrfToken, false)
+	posts, merr := makePosts(ctx, results, csrfToken, false, config.PostsPerPage)
 	if merr != nil {
-		log.Println(merr)
-		return
+		slog.Error("failed to make index posts", "err", merr)
+		return merr
 	}
 
-	var b bytes.Buffer
-	if err := postsTemplate.Execute(&b, posts); err != nil {
-		log.Println(err)
-		return
+	rendered := make(map[locale]string, len(locales))
+	compressed := make(map[locale]*precompressed, len(locales))
+	for _, l := range locales {
+		var b bytes.Buffer
+		traceRender(ctx, "posts", func() { views.writePostList(&b, l, posts) })
+		rendered[l] = b.String()
+		compressed[l] = newPrecompressed(b.Bytes())
 	}
 
 	indexPostsT = now
 	indexPostsRenderedM.Lock()
-	indexPostsRendered = template.HTML(b.String())
+	indexPostsRendered = rendered
+	indexPostsCompressed = compressed
 	indexPostsRenderedM.Unlock()
+	indexRendered.Store(true)
+	indexRenders.Inc()
+	indexRenderDuration.Observe(time.Since(now).Seconds())
+	return nil
 }
 
-func getIndexPosts() template.HTML {
+// refreshIndex re-renders the index after a change and has the other
+// instances do the same.
+func refreshIndex(ctx context.Context) {
+	renderIndexPosts(ctx)
+	publishInvalidation(ctx, invalidateIndex, 0)
+}
+
+func getIndexPosts(loc locale) string {
 	indexPostsRenderedM.RLock()
-	t := indexPostsRendered
+	t := indexPostsRendered[loc]
 	indexPostsRenderedM.RUnlock()
 	return t
 }
 
-func getIndex(w http.ResponseWriter, r *http.Request) {
-	sess := getSession(r)
-	me := sess.User
-	if me.AccountName == "" && sess.UserId != 0 {
-		me = userGet(sess.UserId)
-		sess.User = me
-	}
-	posts := getIndexPosts()
-	indexTemplate.Execute(w,
-		map[string]interface{}{
-			"Me":        me,
-			"CSRFToken": csrfToken,
-			"Flash":     getFlash(w, r, "notice"),
-			"Posts":     posts},
-	)
-}
-
-func getAccountName(c web.C, w http.ResponseWriter, r *http.Request) {
-	user := User{}
-	uerr := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", c.URLParams["accountName"])
+// indexPostsMarker stands in for the posts fragment when the layout is
+// rendered alone, to be spliced with the precompressed fragment.
+const indexPostsMarker = "<!--isuconp:posts-->"
 
-	if uerr != nil {
-		fmt.Println(uerr)
-		return
+func getIndex(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	page := &IndexPage{
+		CSRFToken: csrfToken,
+		Flash:     getFlash(w, r, "notice"),
 	}
 
-	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
+	loc, token := pageLocale(w, r, me), pageCSRFToken(w, r)
 
-	results := []Post{}
-	rerr := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
-	if rerr != nil {
-		fmt.Println(rerr)
-		return
-	}
-	for i := 0; i < len(results); i++ {
-		results[i].User = user
+	indexPostsRenderedM.RLock()
+	pre := indexPostsCompressed[loc]
+	indexPostsRenderedM.RUnlock()
+	if enc := acceptedEncoding(r, encZstd, encGzip); enc != "" && pre != nil && pre.deflate != nil {
+		page.Posts = indexPostsMarker
+		var b bytes.Buffer
+		renderPage(&b, r, "index", me, loc, token, page)
+		prefix, suffix, ok := bytes.Cut(b.Bytes(), []byte(indexPostsMarker))
+		if ok {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Encoding", enc)
+			writeSpliced(w, enc, prefix, pre, suffix)
+			return
+		}
 	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), false)
-	if merr != nil {
-		fmt.Println(merr)
-		return
-	}
+	page.Posts = getIndexPosts(loc)
+	renderPage(w, r, "index", me, loc, token, page)
+}
 
-	commentCount := 0
-	cerr := db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
-	if cerr != nil {
-		fmt.Println(cerr)
+func getAccountName(c web.C, w http.ResponseWriter, r *http.Request) {
+	f, err := loadProfile(r.Context(), c.URLParams["accountName"])
+	if err != nil {
+		reqLogger(r).Error("failed to load user page", "account_name", c.URLParams["accountName"], "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	postIDs := []int{}
-	for _, r := range results {
-		postIDs = append(postIDs, r.ID)
-	}
-	postCount := len(results)
-
-	commentedCount := 0
-	if postCount > 0 {
-		s := []string{}
-		for range postIDs {
-			s = append(s, "?")
-		}
-		placeholder := strings.Join(s, ", ")
-
-		// convert []int -> []interface{}
-		args := make([]interface{}, len(postIDs))
-		for i, v := range postIDs {
-			args[i] = v
-		}
-
-		ccerr := db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
-		if ccerr != nil {
-			fmt.Println(ccerr)
-			return
-		}
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
 	me := getSessionUser(r)
-
-	accountNameTempalte.Execute(w, struct {
-		Posts          []Post
-		User           User
-		PostCount      int
-		CommentCount   int
-		CommentedCount int
-		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+	loc, token := pageLocale(w, r, me), pageCSRFToken(w, r)
+	renderPage(w, r, "user", me, loc, token, &UserPage{User: f.user, Stats: f.stats, Posts: f.html(loc, token)})
 }
 
 func getPosts(w http.ResponseWriter, r *http.Request) {
 	m, parseErr := url.ParseQuery(r.URL.RawQuery)
 	if parseErr != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Println(parseErr)
+		reqLogger(r).Error("failed to parse query", "err", parseErr)
 		return
 	}
 	maxCreatedAt := m.Get("max_created_at")
@@ -612,20 +513,20 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 
 	t, terr := time.Parse(ISO8601_FORMAT, maxCreatedAt)
 	if terr != nil {
-		fmt.Println(terr)
+		reqLogger(r).Warn("invalid max_created_at", "max_created_at", maxCreatedAt, "err", terr)
 		return
 	}
 
 	results := []Post{}
-	err := db.Select(&results, "SELECT posts.`id`, `user_id`, `body`, `mime`, posts.`created_at` FROM `posts` WHERE posts.`created_at` <= ? ORDER BY `created_at` DESC LIMIT 40", t)
+	err := db.SelectContext(r.Context(), &results, "SELECT posts.`id`, `user_id`, `body`, `mime`, posts.`created_at` FROM `posts` WHERE posts.`created_at` <= ? ORDER BY `created_at` DESC LIMIT 40", t)
 	if err != nil {
-		fmt.Println(err)
+		reqLogger(r).Error("failed to select posts", "err", err)
 		return
 	}
 
-	posts, merr := makePosts(results, csrfToken, false)
+	posts, merr := makePosts(r.Context(), results, csrfToken, false, config.PostsPerPage)
 	if merr != nil {
-		fmt.Println(merr)
+		reqLogger(r).Error("failed to make posts", "err", merr)
 		return
 	}
 
@@ -634,13 +535,8 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
-
-	template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
-		getTemplPath("posts.html"),
-	)).Execute(w, posts)
+	loc := pageLocale(w, r, getSessionUser(r))
+	traceRender(r.Context(), "posts", func() { views.writePostList(w, loc, posts) })
 }
 
 func getPostsID(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -651,15 +547,15 @@ func getPostsID(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	results := []Post{}
-	rerr := db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	rerr := db.SelectContext(r.Context(), &results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
 	if rerr != nil {
-		fmt.Println(rerr)
+		reqLogger(r).Error("failed to select post", "post_id", pid, "err", rerr)
 		return
 	}
 
-	posts, merr := makePosts(results, getCSRFToken(r), true)
+	posts, merr := makePosts(r.Context(), results, getCSRFToken(r), true, config.PostsPerPage)
 	if merr != nil {
-		log.Println(merr)
+		reqLogger(r).Error("failed to make posts", "err", merr)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -669,15 +565,13 @@ func getPostsID(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p := posts[0]
-	me := getSessionUser(r)
-	postIDTemplate.Execute(w, struct {
-		Post *Post
-		Me   User
-	}{&p, me})
+	if wantsActivityJSON(r) {
+		getPostNote(w, r, &p)
+		return
+	}
+	writePage(w, r, "post", getSessionUser(r), &PostPage{Post: &p})
 }
 
-var uploadM sync.Mutex
-
 func postIndex(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
 	if !isLogin(me) {
@@ -685,117 +579,77 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadM.Lock()
-	defer uploadM.Unlock()
-	r.ParseMultipartForm(1 << 10)
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(StatusUnprocessableEntity)
+	if !acquireUpload(me.ID) {
+		w.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
+	defer releaseUpload(me.ID)
 
-	file, header, ferr := r.FormFile("file")
-	if ferr != nil {
-		session := getSession(r)
-		session.Notice = "画像が必須です"
-		session.Save(r, w)
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	up, err := readUpload(w, r)
+	defer up.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		err = rejectTooLarge
 	}
-
-	mime := ""
-	if file != nil {
-		defer file.Close()
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Notice = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+	rej, ok := isUploadRejection(err)
+	if err != nil && !ok {
+		reqLogger(r).Error("failed to read upload", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	tf, err := ioutil.TempFile("../upload", "img-")
-	if err != nil {
-		log.Panicf("failed to create image: %v", err)
-	}
-	written, err := io.CopyN(tf, file, UploadLimit+1)
-	if err != nil && err != io.EOF {
-		log.Panicf("failed to write to temporary file: %v", err)
+	// Check the token before anything goes into the session. The form sends
+	// it ahead of the file, so it is there even when a file that is too
+	// large cuts the read short.
+	if up.FormValue("csrf_token") != getCSRFToken(r) {
+		uploadRejections.WithLabelValues(string(rejectCSRF)).Inc()
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
 	}
-	if written > UploadLimit {
-		os.Remove(tf.Name())
-		tf.Close()
+	if ok {
+		uploadRejections.WithLabelValues(string(rej)).Inc()
 		session := getSession(r)
-		session.Notice = "ファイルサイズが大きすぎます"
+		switch rej {
+		case rejectNoFile:
+			session.Notice = "post.no_image"
+		case rejectMime:
+			session.Notice = "post.bad_mime"
+		default:
+			session.Notice = "post.too_large"
+		}
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
-	result, eerr := db.Exec(
-		query,
-		me.ID,
-		mime,
-		[]byte(""),
-		r.FormValue("body"),
-	)
-	if eerr != nil {
-		fmt.Println(eerr.Error())
-		return
-	}
-
-	pid, lerr := result.LastInsertId()
-	if lerr != nil {
-		fmt.Println(lerr.Error())
-		return
-	}
-	tf.Close()
-	copyImage(int(pid), tf.Name(), mime)
-
-	time.Sleep(time.Millisecond * 200)
-	renderIndexPosts()
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
-}
+	uploadBytes.Observe(float64(up.size))
 
-func getImage(c web.C, w http.ResponseWriter, r *http.Request) {
-	pidStr := c.URLParams["id"]
-	pid, err := strconv.Atoi(pidStr)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	// The image is moved into place inside the insert's transaction, so it
+	// is on disk before the post can be listed.
+	p := Post{
+		UserID:  me.ID,
+		Mime:    up.mime,
+		Imgdata: []byte(""),
+		Body:    up.FormValue("body"),
 	}
-
-	post := Post{}
-	derr := db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
-	if derr != nil {
-		fmt.Println(derr.Error())
+	pid, eerr := insertPost(r.Context(), p, func(pid int) (string, error) {
+		return copyImage(pid, up.file.Name(), up.mime)
+	})
+	if eerr != nil {
+		reqLogger(r).Error("failed to insert post", "user_id", me.ID, "err", eerr)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	ext := c.URLParams["ext"]
+	p.ID = pid
+	p.CreatedAt = time.Now()
+	p.User = me
+	apDeliverPost(r, p)
 
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
-		w.Header().Set("Content-Type", post.Mime)
-		_, err := w.Write(post.Imgdata)
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-		writeImage(pid, post.Mime, post.Imgdata)
-		return
-	}
-
-	w.WriteHeader(http.StatusNotFound)
+	// The post is stored; update the caches even if the client has gone.
+	time.Sleep(time.Millisecond * 200)
+	refreshIndex(context.WithoutCancel(r.Context()))
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
 }
 
 func postComment(w http.ResponseWriter, r *http.Request) {
@@ -812,30 +666,28 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 
 	postID, ierr := strconv.Atoi(r.FormValue("post_id"))
 	if ierr != nil {
-		fmt.Println("post_idは整数のみです")
+		reqLogger(r).Warn("post_idは整数のみです", "post_id", r.FormValue("post_id"))
 		return
 	}
 
-	now := time.Now()
-	commentStr := r.FormValue("comment")
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`, `created_at`) VALUES (?,?,?,?)"
-	res, err := db.Exec(query, postID, me.ID, commentStr, now)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	lid, _ := res.LastInsertId()
 	c := Comment{
-		ID:        int(lid),
 		PostID:    postID,
 		UserID:    me.ID,
-		Comment:   commentStr,
-		CreatedAt: now,
+		Comment:   r.FormValue("comment"),
+		CreatedAt: time.Now(),
 		User:      me,
 	}
-	appendComent(c)
+	var err error
+	c.ID, err = insertComment(r.Context(), c)
+	if err != nil {
+		reqLogger(r).Error("failed to insert comment", "post_id", postID, "err", err)
+		return
+	}
+	// The comment is stored; update the caches even if the client has gone.
+	ctx := context.WithoutCancel(r.Context())
+	appendComent(ctx, c)
 	time.Sleep(time.Millisecond * 200)
-	renderIndexPosts()
+	refreshIndex(ctx)
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
 
@@ -852,20 +704,13 @@ func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 	}
 
 	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	err := db.SelectContext(r.Context(), &users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
 	if err != nil {
-		fmt.Println(err)
+		reqLogger(r).Error("failed to select users", "err", err)
 		return
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
-	).Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+	writePage(w, r, "banned", me, &BannedPage{Users: users, CSRFToken: getCSRFToken(r)})
 }
 
 func postAdminBanned(w http.ResponseWriter, r *http.Request) {
@@ -885,83 +730,112 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
-
 	r.ParseForm()
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
-		iid, err := strconv.Atoi(id)
+		uid, err := strconv.Atoi(id)
 		if err != nil {
-			userBan(iid, 1)
+			continue
+		}
+		if err := setUserBan(r.Context(), uid, 1); err != nil {
+			reqLogger(r).Error("failed to ban user", "user_id", uid, "err", err)
 		}
 	}
 
 	time.Sleep(time.Millisecond * 200)
-	renderIndexPosts()
+	refreshIndex(context.WithoutCancel(r.Context()))
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
 }
 
-func main() {
-	host := os.Getenv("ISUCONP_DB_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("ISUCONP_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
+// serve runs the web server. It is the default command.
+func serve(args []string) error {
+	shutdownTracing, err := initTracing(config.TraceExporter, config.TraceFile)
 	if err != nil {
-		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
+		fatal("Failed to initialize tracing.", "err", err)
 	}
-	user := os.Getenv("ISUCONP_DB_USER")
-	if user == "" {
-		user = "root"
+	defer shutdownTracing(context.Background())
+	if err := openAccessLog(config.AccessLog, config.AccessLogFormat); err != nil {
+		fatal("Failed to open access log.", "err", err)
 	}
-	password := os.Getenv("ISUCONP_DB_PASSWORD")
-	dbname := os.Getenv("ISUCONP_DB_NAME")
-	if dbname == "" {
-		dbname = "isuconp"
-	}
-
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true",
-		user,
-		password,
-		host,
-		port,
-		dbname,
-	)
 
-	db, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	if err := openDB(); err != nil {
+		fatal("Failed to connect to DB.", "err", err)
 	}
-	db.SetMaxOpenConns(8)
-	db.SetMaxIdleConns(8)
 	defer db.Close()
-
-	for {
-		if db.Ping() == nil {
-			break
-		}
-		log.Println("waiting db...")
+	if err := openCacheBus(); err != nil {
+		fatal("Failed to set up the cache bus.", "err", err)
 	}
 
-	usersReset()
-	renderIndexPosts()
+	commentCache = newCommentLRU(config.CommentCacheBytes)
+	shutdownTimeout = time.Duration(config.ShutdownTimeout)
+	sessionFile = config.SessionFile
+	loadSessions()
+	onShutdown(saveSessions)
+
+	// Serve /healthz while starting up; /readyz passes once this is done.
+	go func() {
+		if err := waitDB(time.Duration(config.DBWaitTimeout)); err != nil {
+			fatal("DB did not become reachable.", "timeout", config.DBWaitTimeout, "err", err)
+		}
+		if pending, err := pendingMigrations(context.Background()); err != nil {
+			fatal("Failed to check schema migrations.", "err", err)
+		} else if len(pending) > 0 {
+			fatal("Schema is out of date; run `app migrate`.", "pending", len(pending), "next", pending[0].Name)
+		}
+		if err := usersReset(context.Background()); err != nil {
+			fatal("Failed to load users.", "err", err)
+		}
+		for interval := dbWaitMinInterval; renderIndexPosts(context.Background()) != nil; interval = min(interval*2, dbWaitMaxInterval) {
+			slog.Info("retrying index render", "retry_in", interval)
+			time.Sleep(interval)
+		}
+		runCacheBus(context.Background())
+		apInit()
+		started.Store(true)
+		notifyReady()
+	}()
 
-	go http.ListenAndServe(":3000", nil)
+	if config.DebugAddr != "" {
+		serveDebug(config.DebugAddr, requireAdmin(debugMux()))
+	}
 
 	goji.DefaultMux = web.New()
-	goji.Get("/initialize", getInitialize)
+	goji.Use(goji.DefaultMux.Router)
+	goji.Use(requestIDMiddleware)
+	goji.Use(tracingMiddleware)
+	goji.Use(accessLogMiddleware)
+	goji.Use(metricsMiddleware)
+	goji.Use(middleware.Recoverer)
+	goji.Use(startupMiddleware)
+	goji.Use(compressMiddleware)
+	if config.Dev {
+		enableDevQuery()
+		if config.DevSource != "" {
+			go views.watch(context.Background(), config.DevSource)
+		}
+	}
+	goji.Get("/healthz", getHealthz)
+	goji.Get("/readyz", getReadyz)
+	if config.Benchmark {
+		goji.Get("/initialize", getInitialize)
+	}
 	goji.Get("/login", getLogin)
 	goji.Post("/login", postLogin)
 	goji.Get("/register", getRegister)
 	goji.Post("/register", postRegister)
 	goji.Get("/logout", getLogout)
+	goji.Post("/locale", postLocale)
 	goji.Get("/", getIndex)
 	goji.Get(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)$`), getAccountName)
+	goji.Get("/feed.:format", getFeed)
+	goji.Get(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)/feed\.(?P<format>atom|rss)$`), getAccountNameFeed)
+	goji.Get("/tags/:tag/feed.:format", getTagFeed)
+	goji.Get("/.well-known/webfinger", getWebfinger)
+	goji.Get("/users/:accountName", getActor)
+	goji.Get("/users/:accountName/outbox", getOutbox)
+	goji.Get("/users/:accountName/followers", getFollowers)
+	goji.Post("/users/:accountName/inbox", postInbox)
+	goji.Post("/follow", postFollow)
+	goji.Post("/unfollow", postUnfollow)
 	goji.Get("/posts", getPosts)
 	goji.Get("/posts/:id", getPostsID)
 	goji.Post("/", postIndex)
@@ -969,16 +843,41 @@ func main() {
 	goji.Post("/comment", postComment)
 	goji.Get("/admin/banned", getAdminBanned)
 	goji.Post("/admin/banned", postAdminBanned)
-	goji.Get("/*", http.FileServer(http.Dir("../public")))
+	goji.Get("/*", http.FileServer(http.Dir(config.PublicDir)))
 
-	if !flag.Parsed() {
-		flag.Parse()
-	}
 	listener := bind.Default()
 	if ul, ok := listener.(*net.UnixListener); ok {
 		os.Chmod(ul.Addr().String(), 0777)
 	}
-	goji.ServeListener(listener)
+	setupGracefulShutdown(listener)
+
+	// Serve goji's mux itself rather than through goji.ServeListener, which
+	// mounts it on http.DefaultServeMux and would also serve anything
+	// registered there to the public.
+	goji.DefaultMux.Compile()
+	slog.Info("Starting Goji on " + listener.Addr().String())
+	graceful.HandleSignals()
+	bind.Ready()
+	if err := graceful.Serve(listener, goji.DefaultMux); err != nil {
+		fatal("Server failed.", "err", err)
+	}
+	graceful.Wait()
+	return nil
+}
+
+// debugMux serves pprof, the metrics and the admin endpoints. It is only
+// mounted on the debug listener.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/admin/rebuild-cache", postRebuildCache)
+	mux.HandleFunc("/admin/check-users", getCheckUsers)
+	return mux
 }
 
 const sessionName = "isucon_session"
@@ -987,8 +886,9 @@ type Session struct {
 	UserId    int
 	User      User
 	Key       string
-	Notice    string
+	Notice    string // message key
 	CsrfToken string
+	Locale    string
 }
 
 func (s *Session) Save(r *http.Request, w http.ResponseWriter) {
@@ -998,6 +898,9 @@ func (s *Session) Save(r *http.Request, w http.ResponseWriter) {
 type SessionStore struct {
 	sync.Mutex
 	store map[string]*Session
+	// changed records the keys set while the parent of a handoff drains;
+	// see mergeSessions.
+	changed map[string]bool
 }
 
 var sessionStore = SessionStore{
@@ -1033,46 +936,8 @@ func (self *SessionStore) Set(w http.ResponseWriter, sess *Session) {
 
 	self.Lock()
 	self.store[key] = sess
-	self.Unlock()
-}
-
-var (
-	userRepoM sync.Mutex
-	userRepo  map[int]User
-)
-
-func userAdd(u User) {
-	userRepoM.Lock()
-	userRepo[u.ID] = u
-	userRepoM.Unlock()
-}
-
-func userGet(uid int) User {
-	userRepoM.Lock()
-	u := userRepo[uid]
-	userRepoM.Unlock()
-	return u
-}
-
-func userBan(uid, ban int) {
-	userRepoM.Lock()
-	u := userRepo[uid]
-	u.DelFlg = ban
-	userRepo[uid] = u
-	userRepoM.Unlock()
-}
-
-func usersReset() {
-	userRepoM.Lock()
-	defer userRepoM.Unlock()
-
-	userRepo = make(map[int]User)
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM users")
-	if err != nil {
-		panic(err)
-	}
-	for _, u := range users {
-		userRepo[u.ID] = u
+	if self.changed != nil {
+		self.changed[key] = true
 	}
+	self.Unlock()
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subcommands. Flags (see config.go) follow the command name:
+//
+//	app [serve] [flags]
+//	app migrate [flags] [up | down [N] | status]
+//	app initialize [flags]
+//	app create-admin [flags] NAME PASSWORD
+//	app ban|unban [flags] NAME...
+//	app reset-password [flags] NAME [PASSWORD]
+//	app recount [flags]
+//	app rebuild-cache [flags]
+//	app check-users [flags]
+//	app config print [flags]
+//
+// Commands that change data have running servers rebuild their caches,
+// through the cache bus when one is configured and otherwise through the
+// debug listener, so they take effect without a restart.
+
+type command struct {
+	usage string
+	run   func(args []string) error
+	// offline commands do not need the DB.
+	offline bool
+	// files commands use public_dir and upload_dir.
+	files bool
+}
+
+var commands = map[string]command{
+	"serve":          {usage: "run the web server (default)", run: serve, files: true},
+	"migrate":        {usage: "[up | down [N] | status]: apply or revert schema migrations", run: cmdMigrate},
+	"initialize":     {usage: "restore the benchmark's initial data", run: cmdInitialize},
+	"create-admin":   {usage: "NAME PASSWORD: create an administrator", run: cmdCreateAdmin},
+	"ban":            {usage: "NAME...: ban users", run: func(args []string) error { return cmdBan(args, 1) }},
+	"unban":          {usage: "NAME...: lift bans", run: func(args []string) error { return cmdBan(args, 0) }},
+	"reset-password": {usage: "NAME [PASSWORD]: set a new password, random if omitted", run: cmdResetPassword},
+	"recount":        {usage: "rebuild the per-user post and comment counters", run: cmdRecount},
+	"rebuild-cache":  {usage: "reload the running server's caches from the DB", run: cmdRebuildCache, offline: true},
+	"check-users":    {usage: "diff the running server's user cache against the DB", run: cmdCheckUsers, offline: true},
+	"config":         {usage: "print: show the effective configuration", run: cmdConfig, offline: true},
+}
+
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags] [args]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	registerConfigFlags(flag.CommandLine)
+	flag.Usage = usage
+
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	// Positional arguments may come before or after the flags.
+	var pos []string
+	for {
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			break
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+
+	if name == "config" {
+		// Report the configuration even when it does not validate.
+		if err := cmdConfig(pos); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := loadConfig(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cmd.files {
+		if err := config.validateDirs(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	initLogger(config.LogFormat, config.LogLevel)
+
+	if !cmd.offline && name != "serve" {
+		if err := openDB(); err != nil {
+			fatal("Failed to connect to DB.", "err", err)
+		}
+		defer db.Close()
+		if err := waitDB(time.Duration(config.DBWaitTimeout)); err != nil {
+			fatal("DB did not become reachable.", "err", err)
+		}
+		if err := openCacheBus(); err != nil {
+			fatal("Failed to set up the cache bus.", "err", err)
+		}
+	}
+
+	if err := cmd.run(pos); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], name, cmd.usage)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func cmdConfig(args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print [flags]")
+	}
+	err := loadConfig(flag.CommandLine)
+	printConfig(os.Stdout, config)
+	return err
+}
+
+func cmdMigrate(args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		args = []string{"up"}
+	}
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		return migrateUp(ctx)
+	case args[0] == "down" && len(args) <= 2:
+		n := 1
+		if len(args) == 2 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return errUsage
+			}
+		}
+		return migrateDown(ctx, n)
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus(ctx, os.Stdout)
+	}
+	return errUsage
+}
+
+func cmdInitialize(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := dbInitialize(context.Background()); err != nil {
+		return err
+	}
+	notifyServer()
+	return nil
+}
+
+func cmdCreateAdmin(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	if !validateUser(args[0], args[1]) {
+		return errors.New("account name needs 3 or more and password 6 or more of [0-9a-zA-Z_]")
+	}
+	u, err := createUser(context.Background(), args[0], args[1], 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created admin %s (id %d)\n", u.AccountName, u.ID)
+	notifyServer()
+	return nil
+}
+
+func cmdBan(args []string, ban int) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	ctx := context.Background()
+	for _, name := range args {
+		u, err := getUserByName(ctx, name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := setUserBan(ctx, u.ID, ban); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	notifyServer()
+	return nil
+}
+
+func cmdResetPassword(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	password := secureRandomStr(8)
+	if len(args) == 2 {
+		password = args[1]
+	}
+	if !validateUser(args[0], password) {
+		return errors.New("password needs 6 or more of [0-9a-zA-Z_]")
+	}
+	if err := setPassword(context.Background(), args[0], password); err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		fmt.Printf("new password: %s\n", password)
+	}
+	notifyServer()
+	return nil
+}
+
+func cmdRecount(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return recountUserStats(context.Background())
+}
+
+func cmdRebuildCache(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	_, err := debugRequest(http.MethodPost, "/admin/rebuild-cache")
+	return err
+}
+
+func cmdCheckUsers(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	diffs, err := debugRequest(http.MethodGet, "/admin/check-users")
+	os.Stdout.Write(diffs)
+	if err != nil {
+		return err
+	}
+	fmt.Println("user cache matches the DB")
+	return nil
+}
+
+// notifyServer asks running servers to rebuild their caches. Failing to
+// reach one is not an error: the change is picked up at its next start.
+func notifyServer() {
+	if cacheBus != nil {
+		publishInvalidation(context.Background(), invalidateAll, 0)
+		return
+	}
+	if _, err := debugRequest(http.MethodPost, "/admin/rebuild-cache"); err != nil {
+		slog.Warn("could not notify the server; its caches are stale until restart or rebuild-cache", "err", err)
+	}
+}
+
+// debugRequest sends a request to path on the server's debug listener and
+// returns the response body. Statuses other than 200 are errors.
+func debugRequest(method, path string) ([]byte, error) {
+	if config.DebugAddr == "" {
+		return nil, errors.New("debug_addr is not configured")
+	}
+	host, port, err := net.SplitHostPort(config.DebugAddr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	req, err := http.NewRequest(method, "http://"+net.JoinHostPort(host, port)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setAdminToken(req)
+	client := &http.Client{Timeout: time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err == nil && res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return body, err
+}
+
+// postRebuildCache is served on the debug listener for rebuild-cache.
+func postRebuildCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rebuildCaches(r.Context()); err != nil {
+		slog.Error("failed to rebuild caches", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.Info("rebuilt caches")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"strings"
+	"sync"
+)
+
+// Comments are cached per post in a sharded LRU bounded by an estimate of
+// the memory it holds. An entry keeps either a post's full comment list, as
+// shown on /posts/:id, or only its latest commentPreview comments, as shown
+// on the index, user pages and feeds, together with the total count.
+
+const (
+	commentPreview      = 3
+	commentCacheShards  = 16
+	commentEntryBytes   = 96  // list element, map slot and entry header
+	commentFixedBytes   = 128 // one Comment without its strings
+	defaultCommentBytes = 64 << 20
+)
+
+type commentEntry struct {
+	postID   int
+	comments []Comment
+	count    int
+	complete bool
+	size     int64
+}
+
+func (e *commentEntry) computeSize() {
+	e.size = commentEntryBytes
+	for _, c := range e.comments {
+		e.size += commentFixedBytes + int64(len(c.Comment)+len(c.User.AccountName))
+	}
+}
+
+type commentShard struct {
+	sync.Mutex
+	lru      *list.List // front is most recently used
+	byPost   map[int]*list.Element
+	size     int64
+	maxBytes int64
+	// version changes on every add, so that a load racing with a new
+	// comment does not cache the list without it.
+	version uint64
+}
+
+type commentLRU struct {
+	seed   maphash.Seed
+	shards [commentCacheShards]commentShard
+}
+
+var commentCache = newCommentLRU(defaultCommentBytes)
+
+// newCommentLRU returns a cache holding about maxBytes of comments.
+func newCommentLRU(maxBytes int64) *commentLRU {
+	c := &commentLRU{seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].lru = list.New()
+		c.shards[i].byPost = make(map[int]*list.Element)
+		c.shards[i].maxBytes = maxBytes / commentCacheShards
+	}
+	return c
+}
+
+func (c *commentLRU) shard(postID int) *commentShard {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(postID >> (8 * i))
+	}
+	h.Write(b[:])
+	return &c.shards[h.Sum64()%commentCacheShards]
+}
+
+// get returns the cached comments of postID. With all, a preview entry
+// counts as a miss.
+func (c *commentLRU) get(postID int, all bool) ([]Comment, int, bool) {
+	s := c.shard(postID)
+	s.Lock()
+	defer s.Unlock()
+	el, ok := s.byPost[postID]
+	if !ok {
+		return nil, 0, false
+	}
+	e := el.Value.(*commentEntry)
+	if all && !e.complete {
+		return nil, 0, false
+	}
+	s.lru.MoveToFront(el)
+	return e.comments, e.count, true
+}
+
+func (c *commentLRU) version(postID int) uint64 {
+	s := c.shard(postID)
+	s.Lock()
+	defer s.Unlock()
+	return s.version
+}
+
+// put stores e, replacing an older entry and evicting the least recently
+// used ones over the shard's limit. It does nothing if a comment was added
+// to the shard since version was read.
+func (c *commentLRU) put(e *commentEntry, version uint64) {
+	e.computeSize()
+	s := c.shard(e.postID)
+	s.Lock()
+	defer s.Unlock()
+	if s.version != version {
+		return
+	}
+	if el, ok := s.byPost[e.postID]; ok {
+		s.size -= el.Value.(*commentEntry).size
+		el.Value = e
+		s.lru.MoveToFront(el)
+	} else {
+		s.byPost[e.postID] = s.lru.PushFront(e)
+	}
+	s.size += e.size
+	s.evictLocked()
+}
+
+func (s *commentShard) evictLocked() {
+	// Always keep the newest entry, even when it alone is over the limit.
+	for s.size > s.maxBytes && s.lru.Len() > 1 {
+		el := s.lru.Back()
+		e := el.Value.(*commentEntry)
+		s.lru.Remove(el)
+		delete(s.byPost, e.postID)
+		s.size -= e.size
+		commentCacheEvictions.Inc()
+	}
+}
+
+// add appends a new comment to a cached entry. Posts that are not cached
+// load it from the DB on their next read.
+func (c *commentLRU) add(cm Comment) {
+	s := c.shard(cm.PostID)
+	s.Lock()
+	defer s.Unlock()
+	s.version++
+	el, ok := s.byPost[cm.PostID]
+	if !ok {
+		return
+	}
+	old := el.Value.(*commentEntry)
+	// Copy so that slices handed out earlier are never modified.
+	cs := make([]Comment, 0, len(old.comments)+1)
+	cs = append(append(cs, old.comments...), cm)
+	if !old.complete && len(cs) > commentPreview {
+		cs = cs[len(cs)-commentPreview:]
+	}
+	e := &commentEntry{postID: cm.PostID, comments: cs, count: old.count + 1, complete: old.complete}
+	e.computeSize()
+	s.size += e.size - old.size
+	el.Value = e
+	s.lru.MoveToFront(el)
+	s.evictLocked()
+}
+
+// remove drops the entry of postID.
+func (c *commentLRU) remove(postID int) {
+	s := c.shard(postID)
+	s.Lock()
+	defer s.Unlock()
+	s.version++
+	if el, ok := s.byPost[postID]; ok {
+		s.lru.Remove(el)
+		delete(s.byPost, postID)
+		s.size -= el.Value.(*commentEntry).size
+	}
+}
+
+func (c *commentLRU) reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.lru.Init()
+		s.byPost = make(map[int]*list.Element)
+		s.size = 0
+		s.version++
+		s.Unlock()
+	}
+}
+
+func (c *commentLRU) stats() (entries int, bytes int64) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		entries += s.lru.Len()
+		bytes += s.size
+		s.Unlock()
+	}
+	return entries, bytes
+}
+
+// postComments is the comment list shown with a post and the post's total
+// comment count.
+type postComments struct {
+	Comments []Comment
+	Count    int
+}
+
+// loadComments returns the comments of each of postIDs in posting order:
+// all of them, or only the latest commentPreview. Posts missing from the
+// cache are fetched together in one query and cached.
+func loadComments(ctx context.Context, postIDs []int, all bool) map[int]postComments {
+	res := make(map[int]postComments, len(postIDs))
+	var missing []int
+	versions := make(map[int]uint64)
+	for _, id := range postIDs {
+		if cs, n, ok := commentCache.get(id, all); ok {
+			commentCacheHits.Inc()
+			if !all && len(cs) > commentPreview {
+				cs = cs[len(cs)-commentPreview:]
+			}
+			res[id] = postComments{cs, n}
+			continue
+		}
+		commentCacheMisses.Inc()
+		if _, ok := versions[id]; !ok {
+			versions[id] = commentCache.version(id)
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return res
+	}
+
+	args := make([]interface{}, 0, len(missing)+1)
+	for _, id := range missing {
+		args = append(args, id)
+	}
+	limit := ""
+	if !all {
+		limit = " WHERE `rn` <= ?"
+		args = append(args, commentPreview)
+	}
+	query := "SELECT `id`, `post_id`, `comment`, `created_at`, `user_id`, `account_name`, `cnt` FROM (" +
+		"SELECT comments.id, comments.post_id, comments.comment, comments.created_at, users.id AS user_id, users.account_name," +
+		" ROW_NUMBER() OVER (PARTITION BY comments.post_id ORDER BY comments.created_at DESC) AS rn," +
+		" COUNT(*) OVER (PARTITION BY comments.post_id) AS cnt" +
+		" FROM `comments` INNER JOIN users ON comments.user_id = users.id" +
+		" WHERE comments.post_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(missing)), ",") + ")" +
+		") AS c" + limit + " ORDER BY `post_id`, `created_at`"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		ctxLogger(ctx).Error("failed to select comments", "posts", len(missing), "err", err)
+		return res
+	}
+	defer rows.Close()
+
+	loaded := make(map[int]postComments, len(missing))
+	for rows.Next() {
+		var c Comment
+		var count int
+		err := rows.Scan(&c.ID, &c.PostID, &c.Comment, &c.CreatedAt, &c.User.ID, &c.User.AccountName, &count)
+		if err != nil {
+			ctxLogger(ctx).Error("failed to scan comment", "err", err)
+			continue
+		}
+		c.UserID = c.User.ID
+		pc := loaded[c.PostID]
+		pc.Comments = append(pc.Comments, c)
+		pc.Count = count
+		loaded[c.PostID] = pc
+	}
+	if err := rows.Err(); err != nil {
+		ctxLogger(ctx).Error("failed to select comments", "posts", len(missing), "err", err)
+		return res
+	}
+
+	for _, id := range missing {
+		pc := loaded[id]
+		commentCache.put(&commentEntry{
+			postID:   id,
+			comments: pc.Comments,
+			count:    pc.Count,
+			complete: all || pc.Count <= commentPreview,
+		}, versions[id])
+		res[id] = pc
+	}
+	return res
+}
+
+func appendComent(ctx context.Context, c Comment) {
+	commentCache.add(c)
+	publishInvalidation(ctx, invalidateComments, c.PostID)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zenazn/goji/web"
+)
+
+// Response compression. compressMiddleware negotiates br, zstd or gzip from
+// Accept-Encoding and compresses text responses; images, range requests and
+// responses that already carry a Content-Encoding are passed through.
+//
+// The index posts fragment is compressed once per render (see
+// precompressed). getIndex compresses only the small per-request layout
+// around it and splices the two: concatenated zstd frames and deflate
+// blocks ending in a sync flush both decode as one stream.
+
+const (
+	encBrotli = "br"
+	encZstd   = "zstd"
+	encGzip   = "gzip"
+
+	gzipLevel   = 5
+	brotliLevel = 4
+)
+
+// encodingPreference breaks ties between equally weighted encodings.
+var encodingPreference = []string{encBrotli, encZstd, encGzip}
+
+// acceptedEncoding picks the encoding for r, or "" to send it uncompressed.
+// Only encodings in allowed, in order of preference, are considered.
+func acceptedEncoding(r *http.Request, allowed ...string) string {
+	if !config.Compress {
+		return ""
+	}
+	if len(allowed) == 0 {
+		allowed = encodingPreference
+	}
+	q := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(name)] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range allowed {
+		w, ok := q[enc]
+		if !ok {
+			w, ok = q["*"]
+		}
+		if ok && w > bestQ {
+			best, bestQ = enc, w
+		}
+	}
+	return best
+}
+
+func compressible(contentType string) bool {
+	ct, _, _ := strings.Cut(contentType, ";")
+	ct = strings.TrimSpace(strings.ToLower(ct))
+	switch {
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	case ct == "image/svg+xml":
+		return true
+	case strings.HasPrefix(ct, "application/"):
+		return strings.HasSuffix(ct, "json") || strings.HasSuffix(ct, "xml") || strings.HasSuffix(ct, "javascript")
+	}
+	return false
+}
+
+var (
+	gzipPool   = sync.Pool{New: func() interface{} { w, _ := gzip.NewWriterLevel(nil, gzipLevel); return w }}
+	brotliPool = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, brotliLevel) }}
+	zstdPool   = sync.Pool{New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return w
+	}}
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func getEncoder(enc string, w io.Writer) encoder {
+	switch enc {
+	case encGzip:
+		e := gzipPool.Get().(*gzip.Writer)
+		e.Reset(w)
+		return e
+	case encBrotli:
+		e := brotliPool.Get().(*brotli.Writer)
+		e.Reset(w)
+		return e
+	case encZstd:
+		e := zstdPool.Get().(*zstd.Encoder)
+		e.Reset(w)
+		return e
+	}
+	return nil
+}
+
+func putEncoder(e encoder) {
+	switch e := e.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(e)
+	case *brotli.Writer:
+		brotliPool.Put(e)
+	case *zstd.Encoder:
+		zstdPool.Put(e)
+	}
+}
+
+// compressWriter decides whether to compress when the handler first writes
+// the body, once the status and Content-Type are known.
+type compressWriter struct {
+	http.ResponseWriter
+	enc     string
+	code    int
+	decided bool
+	e       encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided && w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *compressWriter) decide(b []byte) {
+	w.decided = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	h := w.Header()
+	ct := h.Get("Content-Type")
+	if ct == "" && len(b) > 0 {
+		ct = http.DetectContentType(b)
+		h.Set("Content-Type", ct)
+	}
+	if w.code != http.StatusNoContent && w.code != http.StatusNotModified && w.code != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && compressible(ct) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.enc)
+		// The compressed bytes differ from the identity response, so a
+		// strong ETag set by the handler would claim both are the same. A
+		// weak one still matches If-None-Match, which is compared weakly.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.e = getEncoder(w.enc, w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decide(b)
+	}
+	if w.e != nil {
+		return w.e.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		return
+	}
+	if w.e != nil {
+		w.e.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("compress: connection cannot be hijacked")
+	}
+	return hj.Hijack()
+}
+
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.code == 0 {
+			return
+		}
+		w.decide(nil)
+	}
+	if w.e != nil {
+		w.e.Close()
+		putEncoder(w.e)
+		w.e = nil
+	}
+}
+
+func compressMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/image/") || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := acceptedEncoding(r)
+		if enc == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, enc: enc}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// precompressed holds an HTML fragment together with its compressed forms,
+// ready to be spliced into a compressed page.
+type precompressed struct {
+	raw     []byte
+	deflate []byte // deflate blocks ending in a sync flush, no final block
+	zstd    []byte // one complete frame
+}
+
+func newPrecompressed(b []byte) *precompressed {
+	p := &precompressed{raw: b}
+	if !config.Compress {
+		return p
+	}
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, gzipLevel)
+	fw.Write(b)
+	fw.Flush()
+	p.deflate = buf.Bytes()
+
+	ze := zstdPool.Get().(*zstd.Encoder)
+	p.zstd = ze.EncodeAll(b, nil)
+	zstdPool.Put(ze)
+	return p
+}
+
+// writeSpliced writes prefix, p and suffix to w as one response body in
+// encoding enc, which must be gzip or zstd.
+func writeSpliced(w io.Writer, enc string, prefix []byte, p *precompressed, suffix []byte) error {
+	var buf bytes.Buffer
+	switch enc {
+	case encZstd:
+		ze := zstdPool.Get().(*zstd.Encoder)
+		out := ze.EncodeAll(prefix, nil)
+		out = append(out, p.zstd...)
+		out = ze.EncodeAll(suffix, out)
+		zstdPool.Put(ze)
+		buf.Write(out)
+	case encGzip:
+		// RFC 1952 member header: deflate, no flags, no mtime, unknown OS.
+		buf.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff})
+		fw, _ := flate.NewWriter(&buf, gzipLevel)
+		fw.Write(prefix)
+		fw.Flush()
+		buf.Write(p.deflate)
+		fw.Reset(&buf)
+		fw.Write(suffix)
+		fw.Close()
+		crc := crc32.Update(crc32.ChecksumIEEE(prefix), crc32.IEEETable, p.raw)
+		crc = crc32.Update(crc, crc32.IEEETable, suffix)
+		var trailer [8]byte
+		binary.LittleEndian.PutUint32(trailer[:4], crc)
+		binary.LittleEndian.PutUint32(trailer[4:], uint32(len(prefix)+len(p.raw)+len(suffix)))
+		buf.Write(trailer[:])
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
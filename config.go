@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every tunable of the app. Values are applied in order from
+// the defaults below, the JSON file given by -config (or ISUCONP_CONFIG),
+// the environment, and finally command line flags. Each field names its
+// environment variable and flag in the struct tags.
+type Config struct {
+	DBHost            string   `json:"db_host" env:"ISUCONP_DB_HOST" flag:"db-host" help:"MySQL host"`
+	DBPort            int      `json:"db_port" env:"ISUCONP_DB_PORT" flag:"db-port" help:"MySQL port"`
+	DBUser            string   `json:"db_user" env:"ISUCONP_DB_USER" flag:"db-user" help:"MySQL user"`
+	DBPassword        string   `json:"db_password" env:"ISUCONP_DB_PASSWORD" flag:"db-password" help:"MySQL password"`
+	DBName            string   `json:"db_name" env:"ISUCONP_DB_NAME" flag:"db-name" help:"MySQL database"`
+	DBMaxOpenConns    int      `json:"db_max_open_conns" env:"ISUCONP_DB_MAX_OPEN_CONNS" flag:"db-max-open-conns" help:"maximum open DB connections"`
+	DBMaxIdleConns    int      `json:"db_max_idle_conns" env:"ISUCONP_DB_MAX_IDLE_CONNS" flag:"db-max-idle-conns" help:"maximum idle DB connections"`
+	DBWaitTimeout     Duration `json:"db_wait_timeout" env:"ISUCONP_DB_WAIT_TIMEOUT" flag:"db-wait-timeout" help:"how long to wait for the DB at startup"`
+	PostsPerPage      int      `json:"posts_per_page" env:"ISUCONP_POSTS_PER_PAGE" flag:"posts-per-page" help:"posts shown per page"`
+	UploadsPerUser    int      `json:"uploads_per_user" env:"ISUCONP_UPLOADS_PER_USER" flag:"uploads-per-user" help:"concurrent uploads allowed per user"`
+	UploadLimit       int64    `json:"upload_limit" env:"ISUCONP_UPLOAD_LIMIT" flag:"upload-limit" help:"maximum image size in bytes"`
+	CommentCacheBytes int64    `json:"comment_cache_bytes" env:"ISUCONP_COMMENT_CACHE_BYTES" flag:"comment-cache-bytes" help:"memory limit of the comment cache"`
+	CacheBus          string   `json:"cache_bus" env:"ISUCONP_CACHE_BUS" flag:"cache-bus" help:"cache invalidation between instances: db or redis, empty to disable"`
+	CacheBusPoll      Duration `json:"cache_bus_poll" env:"ISUCONP_CACHE_BUS_POLL" flag:"cache-bus-poll" help:"poll interval of the db cache bus"`
+	RedisAddr         string   `json:"redis_addr" env:"ISUCONP_REDIS_ADDR" flag:"redis-addr" help:"Redis address for the redis cache bus"`
+	PublicDir         string   `json:"public_dir" env:"ISUCONP_PUBLIC_DIR" flag:"public-dir" help:"static files and images"`
+	UploadDir         string   `json:"upload_dir" env:"ISUCONP_UPLOAD_DIR" flag:"upload-dir" help:"temporary directory for uploads"`
+	ImageAccelPrefix  string   `json:"image_accel_prefix" env:"ISUCONP_IMAGE_ACCEL_PREFIX" flag:"image-accel-prefix" help:"nginx internal location for images, empty to serve them directly"`
+	Compress          bool     `json:"compress" env:"ISUCONP_COMPRESS" flag:"compress" help:"compress responses with br, zstd or gzip"`
+	DebugAddr         string   `json:"debug_addr" env:"ISUCONP_DEBUG_ADDR" flag:"debug-addr" help:"pprof, metrics and admin listen address, empty to disable"`
+	AdminToken        string   `json:"admin_token" env:"ISUCONP_ADMIN_TOKEN" flag:"admin-token" help:"shared secret for the debug listener"`
+	Benchmark         bool     `json:"benchmark" env:"ISUCONP_BENCHMARK" flag:"benchmark" help:"enable GET /initialize for the benchmarker"`
+	LogFormat         string   `json:"log_format" env:"ISUCONP_LOG_FORMAT" flag:"log-format" help:"text or json"`
+	LogLevel          string   `json:"log_level" env:"ISUCONP_LOG_LEVEL" flag:"log-level" help:"debug, info, warn or error"`
+	AccessLog         string   `json:"access_log" env:"ISUCONP_ACCESS_LOG" flag:"access-log" help:"access log path, empty to disable"`
+	AccessLogFormat   string   `json:"access_log_format" env:"ISUCONP_ACCESS_LOG_FORMAT" flag:"access-log-format" help:"ltsv or json"`
+	TraceExporter     string   `json:"trace_exporter" env:"ISUCONP_TRACE_EXPORTER" flag:"trace-exporter" help:"otlp, stdout or file, empty to disable"`
+	TraceFile         string   `json:"trace_file" env:"ISUCONP_TRACE_FILE" flag:"trace-file" help:"span output for the file exporter"`
+	Dev               bool     `json:"dev" env:"ISUCONP_DEV" flag:"dev" help:"development mode"`
+	DevMaxQueries     int      `json:"dev_max_queries" env:"ISUCONP_DEV_MAX_QUERIES" flag:"dev-max-queries" help:"queries per request before warning"`
+	DevSlowQuery      Duration `json:"dev_slow_query" env:"ISUCONP_DEV_SLOW_QUERY" flag:"dev-slow-query" help:"statement duration logged as slow"`
+	DevRepeat         int      `json:"dev_repeat" env:"ISUCONP_DEV_REPEAT" flag:"dev-repeat" help:"repeats of a statement reported as N+1"`
+	DevSource         string   `json:"dev_source" env:"ISUCONP_DEV_SOURCE" flag:"dev-source" help:"source tree whose templates/ are reloaded on change in a -tags dev build, empty to use the embedded ones"`
+	APKey             string   `json:"ap_key" env:"ISUCONP_AP_KEY" flag:"ap-key" help:"ActivityPub signing key"`
+	APInsecure        bool     `json:"ap_insecure" env:"ISUCONP_AP_INSECURE" flag:"ap-insecure" help:"federate over plain http"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout" env:"ISUCONP_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" help:"how long to drain requests on shutdown"`
+	SessionFile       string   `json:"session_file" env:"ISUCONP_SESSION_FILE" flag:"session-file" help:"where sessions are kept across restarts"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DBHost:            "localhost",
+		DBPort:            3306,
+		DBUser:            "root",
+		DBName:            "isuconp",
+		DBMaxOpenConns:    8,
+		DBMaxIdleConns:    8,
+		DBWaitTimeout:     Duration(time.Minute),
+		PostsPerPage:      20,
+		UploadsPerUser:    2,
+		UploadLimit:       10 * 1024 * 1024, // 10mb
+		CommentCacheBytes: defaultCommentBytes,
+		CacheBusPoll:      Duration(500 * time.Millisecond),
+		RedisAddr:         "localhost:6379",
+		PublicDir:         "../public",
+		UploadDir:         "../upload",
+		DebugAddr:         "127.0.0.1:3000",
+		LogFormat:         "text",
+		LogLevel:          "info",
+		AccessLogFormat:   accessLogLTSV,
+		DevMaxQueries:     20,
+		DevSlowQuery:      Duration(100 * time.Millisecond),
+		DevRepeat:         5,
+		APKey:             "../ap_key.pem",
+		ShutdownTimeout:   Duration(30 * time.Second),
+		Compress:          true,
+	}
+}
+
+var config = defaultConfig()
+
+// Duration is a time.Duration written as "1m30s" in the config file.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// fieldValue is a flag.Value setting one Config field from a string.
+type fieldValue struct {
+	v reflect.Value
+}
+
+func (f fieldValue) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f fieldValue) Set(s string) error {
+	if d, ok := f.v.Addr().Interface().(*Duration); ok {
+		return d.Set(s)
+	}
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	default:
+		return fmt.Errorf("config: unsupported type %s", f.v.Type())
+	}
+	return nil
+}
+
+func (f fieldValue) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
+
+// configFields calls fn for every field of c with its struct tags.
+func configFields(c *Config, fn func(tag reflect.StructTag, v reflect.Value)) {
+	rv := reflect.ValueOf(c).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		fn(rt.Field(i).Tag, rv.Field(i))
+	}
+}
+
+var configPath string
+
+// registerConfigFlags adds -config and one flag per Config field to fs. The
+// flags write into config when fs is parsed.
+func registerConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", os.Getenv("ISUCONP_CONFIG"), "JSON config file")
+	configFields(&config, func(tag reflect.StructTag, v reflect.Value) {
+		fs.Var(fieldValue{v}, tag.Get("flag"), tag.Get("help"))
+	})
+}
+
+// loadConfig rebuilds config from defaults, file and environment, then
+// re-applies the flags that were set explicitly on fs.
+func loadConfig(fs *flag.FlagSet) error {
+	c := defaultConfig()
+	if configPath != "" {
+		f, err := os.Open(configPath)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&c)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("config: %s: %v", configPath, err)
+		}
+	}
+
+	var err error
+	configFields(&c, func(tag reflect.StructTag, v reflect.Value) {
+		s, ok := os.LookupEnv(tag.Get("env"))
+		if !ok || err != nil {
+			return
+		}
+		if serr := (fieldValue{v}).Set(s); serr != nil {
+			err = fmt.Errorf("config: %s: %v", tag.Get("env"), serr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+	configFields(&c, func(tag reflect.StructTag, v reflect.Value) {
+		if s, ok := flags[tag.Get("flag")]; ok && err == nil {
+			err = (fieldValue{v}).Set(s)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	config = c
+	return config.validate()
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.DBPort > 0 && c.DBPort < 65536, "db_port: %d is not a port number", c.DBPort)
+	check(c.DBMaxOpenConns > 0, "db_max_open_conns: must be positive")
+	check(c.DBMaxIdleConns >= 0, "db_max_idle_conns: must not be negative")
+	check(c.PostsPerPage > 0, "posts_per_page: must be positive")
+	check(c.UploadLimit > 0, "upload_limit: must be positive")
+	check(c.UploadsPerUser > 0, "uploads_per_user: must be positive")
+	check(c.ImageAccelPrefix == "" || strings.HasPrefix(c.ImageAccelPrefix, "/") && !strings.HasSuffix(c.ImageAccelPrefix, "/"),
+		"image_accel_prefix: %q must start and must not end with /", c.ImageAccelPrefix)
+	check(c.CommentCacheBytes > 0, "comment_cache_bytes: must be positive")
+	check(c.CacheBus == "" || c.CacheBus == "db" || c.CacheBus == "redis", "cache_bus: %q is not db or redis", c.CacheBus)
+	check(c.CacheBusPoll > 0, "cache_bus_poll: must be positive")
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format: %q is not text or json", c.LogFormat)
+	check(c.AccessLogFormat == accessLogLTSV || c.AccessLogFormat == accessLogJSON,
+		"access_log_format: %q is not ltsv or json", c.AccessLogFormat)
+	switch c.TraceExporter {
+	case "", "otlp", "stdout":
+	case "file":
+		check(c.TraceFile != "", "trace_file: required by the file exporter")
+	default:
+		check(false, "trace_exporter: %q is not otlp, stdout or file", c.TraceExporter)
+	}
+	if c.DebugAddr != "" && c.AdminToken == "" {
+		check(isLoopbackAddr(c.DebugAddr), "admin_token: required when debug_addr %s is not a loopback address", c.DebugAddr)
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// validateDirs checks the directories that only the server reads and
+// writes, so that the other commands run wherever the config is.
+func (c *Config) validateDirs() error {
+	var errs []string
+	for _, d := range []struct{ key, path string }{{"public_dir", c.PublicDir}, {"upload_dir", c.UploadDir}} {
+		if st, err := os.Stat(d.path); err != nil || !st.IsDir() {
+			errs = append(errs, fmt.Sprintf("%s: %s is not a directory", d.key, d.path))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// dsn returns the MySQL data source name for c.
+func (c *Config) dsn() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true",
+		c.DBUser,
+		c.DBPassword,
+		c.DBHost,
+		c.DBPort,
+		c.DBName,
+	)
+}
+
+// printConfig writes c as a config file, with secrets masked.
+func printConfig(w io.Writer, c Config) error {
+	if c.DBPassword != "" {
+		c.DBPassword = "********"
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = "********"
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// Development mode query accounting. Every request counts its statements;
+// requests issuing more than maxQueries, statements slower than slowQuery,
+// and statements repeated at least repeatThreshold times (likely N+1s) are
+// logged. The per-request summary is sent in X-Query-Summary.
+
+const querySummaryHeader = "X-Query-Summary"
+
+type queryStatsKey struct{}
+
+type devQueryConfig struct {
+	maxQueries      int
+	slowQuery       time.Duration
+	repeatThreshold int
+}
+
+var devQuery = devQueryConfig{
+	maxQueries:      20,
+	slowQuery:       100 * time.Millisecond,
+	repeatThreshold: 5,
+}
+
+type queryStats struct {
+	sync.Mutex
+	count  int
+	total  time.Duration
+	errors int
+	counts map[string]int
+}
+
+func (s *queryStats) add(query string, d time.Duration, err error) {
+	s.Lock()
+	s.count++
+	s.total += d
+	if err != nil {
+		s.errors++
+	}
+	s.counts[normalizeQuery(query)]++
+	s.Unlock()
+}
+
+type repeatedQuery struct {
+	Query string
+	Count int
+}
+
+// repeated returns the statements run at least n times, most frequent first.
+func (s *queryStats) repeated(n int) []repeatedQuery {
+	s.Lock()
+	defer s.Unlock()
+	var rs []repeatedQuery
+	for q, c := range s.counts {
+		if c >= n {
+			rs = append(rs, repeatedQuery{q, c})
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Count > rs[j].Count })
+	return rs
+}
+
+func (s *queryStats) summary() string {
+	rs := s.repeated(devQuery.repeatThreshold)
+	s.Lock()
+	defer s.Unlock()
+	return fmt.Sprintf("queries=%d; time=%.3fms; errors=%d; distinct=%d; repeated=%d",
+		s.count, float64(s.total)/float64(time.Millisecond), s.errors, len(s.counts), len(rs))
+}
+
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// enableDevQuery turns on query accounting with the dev_* thresholds of
+// config.
+func enableDevQuery() {
+	devQuery.maxQueries = config.DevMaxQueries
+	devQuery.slowQuery = time.Duration(config.DevSlowQuery)
+	if config.DevRepeat > 1 {
+		devQuery.repeatThreshold = config.DevRepeat
+	}
+	queryHooks = append(queryHooks, recordDevQuery)
+	goji.Use(devQueryMiddleware)
+}
+
+func recordDevQuery(ctx context.Context, query string, d time.Duration, err error) {
+	if d >= devQuery.slowQuery {
+		ctxLogger(ctx).Warn("slow query", "query", normalizeQuery(query), "duration", d)
+	}
+	if s, ok := ctx.Value(queryStatsKey{}).(*queryStats); ok {
+		s.add(query, d, err)
+	}
+}
+
+// summaryWriter adds X-Query-Summary just before the header is sent. Like
+// headerTimer it passes on the optional interfaces of the writer it wraps.
+type summaryWriter struct {
+	mutil.WriterProxy
+	stats   *queryStats
+	written bool
+}
+
+func (w *summaryWriter) summarize() {
+	if !w.written {
+		w.written = true
+		w.Header().Set(querySummaryHeader, w.stats.summary())
+	}
+}
+
+func (w *summaryWriter) WriteHeader(code int) {
+	w.summarize()
+	w.WriterProxy.WriteHeader(code)
+}
+
+func (w *summaryWriter) Write(b []byte) (int, error) {
+	w.summarize()
+	return w.WriterProxy.Write(b)
+}
+
+func (w *summaryWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.summarize()
+	if rf, ok := w.WriterProxy.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{w.WriterProxy}, r)
+}
+
+func (w *summaryWriter) Flush() {
+	w.summarize()
+	if f, ok := w.WriterProxy.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over without a summary: the handler writes
+// its own response, if any, and no header is sent after it.
+func (w *summaryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.WriterProxy.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("devquery: connection does not support hijacking")
+	}
+	w.written = true
+	return hj.Hijack()
+}
+
+func devQueryMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		stats := &queryStats{counts: make(map[string]int)}
+		ww := &summaryWriter{WriterProxy: mutil.WrapWriter(w), stats: stats}
+		h.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), queryStatsKey{}, stats)))
+		if !ww.written {
+			ww.WriteHeader(http.StatusOK)
+		}
+
+		l := reqLogger(r)
+		if stats.count > devQuery.maxQueries {
+			l.Warn("too many queries", "route", routePattern(c), "summary", stats.summary())
+		}
+		for _, rq := range stats.repeated(devQuery.repeatThreshold) {
+			l.Warn("possible N+1 query", "route", routePattern(c), "query", rq.Query, "count", rq.Count)
+		}
+		if l.Enabled(r.Context(), slog.LevelDebug) {
+			l.Debug("query summary", "route", routePattern(c), "summary", stats.summary())
+		}
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	feedAtom = "atom"
+	feedRSS  = "rss"
+
+	feedTitleLength = 40
+	feedPosts       = 40
+	// feedFetch posts are read for a feed, as those of banned users are
+	// dropped afterwards.
+	feedFetch = 2 * feedPosts
+	// tagFeedBatch is how many LIKE matches are read at a time while
+	// looking for posts with the tag.
+	tagFeedBatch = 200
+)
+
+var tagRegexp = regexp.MustCompile(`\A[^\s#%_\\]+\z`)
+
+// feed is the format independent representation of a timeline.
+type feed struct {
+	Title   string
+	Link    string // HTML page of the timeline
+	Self    string // URL of the feed itself
+	Posts   []Post
+	Updated time.Time
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Links     []atomLink `xml:"link"`
+	Author    atomPerson `xml:"author"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Author      string  `xml:"dc:creator"`
+	Description string  `xml:"description"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// absoluteURL returns the URL of p as seen by the client of r.
+func absoluteURL(r *http.Request, p string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + p
+}
+
+func postTitle(p *Post) string {
+	t := strings.TrimSpace(p.Body)
+	if i := strings.IndexByte(t, '\n'); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	if utf8.RuneCountInString(t) > feedTitleLength {
+		t = string([]rune(t)[:feedTitleLength]) + "…"
+	}
+	if t == "" {
+		t = "@" + p.User.AccountName
+	}
+	return t
+}
+
+func postContent(r *http.Request, p *Post) string {
+	return fmt.Sprintf(`<p><img src="%s"></p><p>%s</p>`,
+		html.EscapeString(absoluteURL(r, imageURL(p))),
+		strings.Replace(html.EscapeString(p.Body), "\n", "<br>", -1))
+}
+
+func (f *feed) atom(r *http.Request) interface{} {
+	af := atomFeed{
+		Title:   f.Title,
+		ID:      f.Self,
+		Updated: f.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.Self},
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+		},
+	}
+	for i := range f.Posts {
+		p := &f.Posts[i]
+		link := absoluteURL(r, "/posts/"+strconv.Itoa(p.ID))
+		af.Entries = append(af.Entries, atomEntry{
+			Title:     postTitle(p),
+			ID:        link,
+			Updated:   p.CreatedAt.Format(time.RFC3339),
+			Published: p.CreatedAt.Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: link},
+				{Rel: "enclosure", Type: p.Mime, Href: absoluteURL(r, imageURL(p))},
+			},
+			Author: atomPerson{
+				Name: p.User.AccountName,
+				URI:  absoluteURL(r, "/@"+p.User.AccountName),
+			},
+			Content: atomText{Type: "html", Body: postContent(r, p)},
+		})
+	}
+	return af
+}
+
+func (f *feed) rss(r *http.Request) interface{} {
+	rf := rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   f.Title,
+			LastBuildDate: f.Updated.Format(time.RFC1123Z),
+		},
+	}
+	for i := range f.Posts {
+		p := &f.Posts[i]
+		link := absoluteURL(r, "/posts/"+strconv.Itoa(p.ID))
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       postTitle(p),
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     p.CreatedAt.Format(time.RFC1123Z),
+			Author:      p.User.AccountName,
+			Description: postContent(r, p),
+		})
+	}
+	return rf
+}
+
+// etag identifies the set of posts in the feed, so banning a user changes it
+// even when no new post was made.
+func (f *feed) etag(format string) string {
+	h := sha1.New()
+	fmt.Fprint(h, format)
+	for _, p := range f.Posts {
+		fmt.Fprintf(h, ",%d", p.ID)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+func serveFeed(w http.ResponseWriter, r *http.Request, format string, results []Post, f *feed) {
+	posts, merr := makePosts(r.Context(), results, "", false, feedPosts)
+	if merr != nil {
+		reqLogger(r).Error("failed to make feed posts", "err", merr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Posts = posts
+	f.Self = absoluteURL(r, r.URL.Path)
+	f.Link = absoluteURL(r, f.Link)
+	if len(posts) > 0 {
+		f.Updated = posts[0].CreatedAt
+	}
+
+	var (
+		doc         interface{}
+		contentType string
+	)
+	switch format {
+	case feedAtom:
+		doc, contentType = f.atom(r), "application/atom+xml; charset=utf-8"
+	case feedRSS:
+		doc, contentType = f.rss(r), "application/rss+xml; charset=utf-8"
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := xml.NewEncoder(&b).Encode(doc); err != nil {
+		reqLogger(r).Error("failed to encode feed", "format", format, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", f.etag(format))
+	http.ServeContent(w, r, "", f.Updated, bytes.NewReader(b.Bytes()))
+}
+
+func getFeed(c web.C, w http.ResponseWriter, r *http.Request) {
+	results := []Post{}
+	err := db.SelectContext(r.Context(), &results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` ORDER BY `created_at` DESC LIMIT ?", feedFetch)
+	if err != nil {
+		reqLogger(r).Error("failed to select feed posts", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	serveFeed(w, r, c.URLParams["format"], results, &feed{
+		Title: "Iscogram",
+		Link:  "/",
+	})
+}
+
+func getAccountNameFeed(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	uerr := db.GetContext(r.Context(), &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", c.URLParams["accountName"])
+	if uerr == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if uerr != nil {
+		reqLogger(r).Error("failed to select feed user", "account_name", c.URLParams["accountName"], "err", uerr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	results := []Post{}
+	err := db.SelectContext(r.Context(), &results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, feedFetch)
+	if err != nil {
+		reqLogger(r).Error("failed to select feed posts", "user_id", user.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	serveFeed(w, r, c.URLParams["format"], results, &feed{
+		Title: user.AccountName + " - Iscogram",
+		Link:  "/@" + user.AccountName,
+	})
+}
+
+// hasTag reports whether body contains "#tag" as a whole hashtag, that is
+// not followed by a letter, a digit or "_", so "#cat." and "#cat)" are the
+// tag cat and "#cats" is not.
+func hasTag(body, tag string) bool {
+	for {
+		i := strings.Index(body, "#"+tag)
+		if i < 0 {
+			return false
+		}
+		body = body[i+1+len(tag):]
+		r, _ := utf8.DecodeRuneInString(body)
+		if body == "" || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			return true
+		}
+	}
+}
+
+// getTagFeed serves posts whose body contains the hashtag "#tag". LIKE
+// also matches longer tags starting with tag, so the candidates are checked
+// with hasTag.
+func getTagFeed(c web.C, w http.ResponseWriter, r *http.Request) {
+	tag := c.URLParams["tag"]
+	if !tagRegexp.MatchString(tag) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	results := []Post{}
+	for offset := 0; len(results) < feedFetch; offset += tagFeedBatch {
+		batch := []Post{}
+		err := db.SelectContext(r.Context(), &batch, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `body` LIKE ? ORDER BY `created_at` DESC LIMIT ? OFFSET ?", "%#"+tag+"%", tagFeedBatch, offset)
+		if err != nil {
+			reqLogger(r).Error("failed to select feed posts", "tag", tag, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, p := range batch {
+			if len(results) < feedFetch && hasTag(p.Body, tag) {
+				results = append(results, p)
+			}
+		}
+		if len(batch) < tagFeedBatch {
+			break
+		}
+	}
+	serveFeed(w, r, c.URLParams["format"], results, &feed{
+		Title: "#" + tag + " - Iscogram",
+		Link:  "/",
+	})
+}
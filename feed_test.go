@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHasTag(t *testing.T) {
+	tests := []struct {
+		body string
+		tag  string
+		want bool
+	}{
+		{"#cat", "cat", true},
+		{"my #cat", "cat", true},
+		{"#cat is here", "cat", true},
+		{"#cat\nnext line", "cat", true},
+		{"#cat　全角スペース", "cat", true},
+		{"#cat#dog", "cat", true},
+		{"#cat.", "cat", true},
+		{"#cat,", "cat", true},
+		{"(#cat)", "cat", true},
+		{"#cat!", "cat", true},
+		{"#cats", "cat", false},
+		{"#cat_food", "cat", false},
+		{"#cat2", "cat", false},
+		{"#catねこ", "cat", false},
+		{"#cats and #cat", "cat", true},
+		{"#cats and #catfish", "cat", false},
+		{"cat", "cat", false},
+		{"#Cat", "cat", false},
+		{"#ねこ", "ねこ", true},
+		{"#ねこです", "ねこ", false},
+		{"#c++ rocks", "c++", true},
+		{"", "cat", false},
+	}
+	for _, tt := range tests {
+		if got := hasTag(tt.body, tt.tag); got != tt.want {
+			t.Errorf("hasTag(%q, %q) = %v, want %v", tt.body, tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestPostTitle(t *testing.T) {
+	long := strings.Repeat("あ", feedTitleLength+5)
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"hello", "hello"},
+		{"  hello  ", "hello"},
+		{"first line\nsecond line", "first line"},
+		{"\n  \nsecond", "second"},
+		{"", "@alice"},
+		{"   ", "@alice"},
+		{long, strings.Repeat("あ", feedTitleLength) + "…"},
+		{strings.Repeat("a", feedTitleLength), strings.Repeat("a", feedTitleLength)},
+	}
+	for _, tt := range tests {
+		p := &Post{Body: tt.body, User: User{AccountName: "alice"}}
+		if got := postTitle(p); got != tt.want {
+			t.Errorf("postTitle(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestFeedETag(t *testing.T) {
+	f := &feed{Posts: []Post{{ID: 1}, {ID: 2}}}
+	if f.etag(feedAtom) == f.etag(feedRSS) {
+		t.Error("atom and rss feeds share an ETag")
+	}
+	g := &feed{Posts: []Post{{ID: 1}, {ID: 3}}}
+	if f.etag(feedAtom) == g.etag(feedAtom) {
+		t.Error("feeds with different posts share an ETag")
+	}
+	if h := (&feed{Posts: []Post{{ID: 1}, {ID: 2}}}); f.etag(feedAtom) != h.etag(feedAtom) {
+		t.Error("the same posts give different ETags")
+	}
+}
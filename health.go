@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dbPingTimeout     = time.Second
+	dbWaitMinInterval = 100 * time.Millisecond
+	dbWaitMaxInterval = 5 * time.Second
+)
+
+var (
+	dbReachable   atomic.Bool
+	usersLoaded   atomic.Bool
+	indexRendered atomic.Bool
+	// started is set once startup has finished; until then startupMiddleware
+	// answers 503.
+	started atomic.Bool
+)
+
+// waitDB pings the DB with exponential backoff until it answers or timeout
+// elapses.
+func waitDB(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	interval := dbWaitMinInterval
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			dbReachable.Store(true)
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return err
+		}
+		slog.Info("waiting db...", "err", err, "retry_in", interval)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > dbWaitMaxInterval {
+			interval = dbWaitMaxInterval
+		}
+	}
+}
+
+// startupMiddleware answers 503 to everything but the probes until startup
+// has loaded the users and rendered the index, so that no one sees an empty
+// timeline or fails to log in in the meantime.
+func startupMiddleware(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz":
+		default:
+			if !started.Load() {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// getHealthz is the liveness probe: the process is up and serving.
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// getReadyz is the readiness probe. It passes once startup has loaded the
+// user cache and rendered the index, and while the DB answers a ping.
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	var err error
+	switch {
+	case !dbReachable.Load():
+		err = errors.New("db: not reachable yet")
+	case !usersLoaded.Load():
+		err = errors.New("users: not loaded")
+	case !indexRendered.Load():
+		err = errors.New("index: not rendered")
+	case !started.Load():
+		err = errors.New("startup: not finished")
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), dbPingTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
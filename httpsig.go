@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HTTP Signatures (draft-cavage-http-signatures) as used by ActivityPub
+// servers. Only rsa-sha256 is supported.
+
+const (
+	signatureMaxSkew = 5 * time.Minute
+)
+
+var (
+	errNoSignature  = errors.New("httpsig: no Signature header")
+	errBadSignature = errors.New("httpsig: malformed Signature header")
+	errBadDigest    = errors.New("httpsig: Digest mismatch")
+	errStaleDate    = errors.New("httpsig: Date is out of range")
+	errUnsigned     = errors.New("httpsig: required header not signed")
+
+	signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+	// requiredHeaders must be covered by every signature we accept, so that
+	// it cannot be replayed later or against another inbox. Requests with a
+	// body must also sign digest.
+	requiredHeaders = []string{"(request-target)", "host", "date"}
+)
+
+// loadOrCreateKey reads a PEM encoded RSA private key from path, generating
+// and saving a new one if the file does not exist.
+func loadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		return key, ioutil.WriteFile(path, b, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("httpsig: no PEM data in %s", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func publicKeyPEM(key *rsa.PrivateKey) string {
+	b, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+}
+
+func parsePublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("httpsig: no PEM data in publicKeyPem")
+	}
+	if k, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rk, ok := k.(*rsa.PublicKey); ok {
+			return rk, nil
+		}
+		return nil, errors.New("httpsig: not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, h+": "+strings.ToLower(r.Method)+" "+r.URL.RequestURI())
+		case "host":
+			lines = append(lines, h+": "+r.Host)
+		default:
+			lines = append(lines, h+": "+r.Header.Get(h))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signRequest adds Date, Digest and Signature headers to r. body must be
+// the same bytes as r.Body.
+func signRequest(r *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", bodyDigest(body))
+
+	sum := sha256.Sum256([]byte(signingString(r, signedHeaders)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+type signature struct {
+	KeyID     string
+	Headers   []string
+	Signature []byte
+}
+
+func parseSignature(r *http.Request) (*signature, error) {
+	h := r.Header.Get("Signature")
+	if h == "" {
+		return nil, errNoSignature
+	}
+	sig := &signature{Headers: []string{"date"}}
+	for _, kv := range strings.Split(h, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, errBadSignature
+		}
+		k, v := strings.TrimSpace(kv[:i]), strings.Trim(strings.TrimSpace(kv[i+1:]), `"`)
+		switch k {
+		case "keyId":
+			sig.KeyID = v
+		case "headers":
+			sig.Headers = strings.Fields(strings.ToLower(v))
+		case "signature":
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, errBadSignature
+			}
+			sig.Signature = b
+		}
+	}
+	if sig.KeyID == "" || sig.Signature == nil {
+		return nil, errBadSignature
+	}
+	return sig, nil
+}
+
+// verifyRequest checks the Signature of r against the key returned by
+// lookup, and the Digest against body. It returns the keyId that signed r.
+func verifyRequest(r *http.Request, body []byte, lookup func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return "", err
+	}
+	required := requiredHeaders
+	if body != nil {
+		required = signedHeaders
+	}
+	for _, h := range required {
+		if !slices.Contains(sig.Headers, h) {
+			return "", errUnsigned
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date) > signatureMaxSkew || time.Until(date) > signatureMaxSkew {
+		return "", errStaleDate
+	}
+	if body != nil {
+		digest := r.Header.Get("Digest")
+		if digest == "" || !bytes.Equal([]byte(digest), []byte(bodyDigest(body))) {
+			return "", errBadDigest
+		}
+	}
+
+	key, err := lookup(sig.KeyID)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(signingString(r, sig.Headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig.Signature); err != nil {
+		return "", err
+	}
+	return sig.KeyID, nil
+}
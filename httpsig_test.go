@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyID = "https://example.com/users/alice#main-key"
+
+var testKey = func() *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}()
+
+func signedInboxRequest(t *testing.T, body []byte) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("POST", "https://example.com/users/bob/inbox", bytes.NewReader(body))
+	if err := signRequest(r, testKeyID, testKey, body); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func lookupTestKey(keyID string) (*rsa.PublicKey, error) {
+	if keyID != testKeyID {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	return &testKey.PublicKey, nil
+}
+
+// resign replaces the signature of r with one over headers.
+func resign(t *testing.T, r *http.Request, headers []string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(signingString(r, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		testKeyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	keyID, err := verifyRequest(signedInboxRequest(t, body), body, lookupTestKey)
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if keyID != testKeyID {
+		t.Errorf("keyID = %q, want %q", keyID, testKeyID)
+	}
+}
+
+func TestVerifyRequestTampered(t *testing.T) {
+	body := []byte(`{"type":"Follow"}`)
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request) []byte
+		want   error
+	}{
+		{"body", func(r *http.Request) []byte { return []byte(`{"type":"Undo"}`) }, errBadDigest},
+		{"digest", func(r *http.Request) []byte {
+			other := []byte(`{"type":"Undo"}`)
+			r.Header.Set("Digest", bodyDigest(other))
+			return other
+		}, nil},
+		{"path", func(r *http.Request) []byte { r.URL.Path = "/users/carol/inbox"; return body }, nil},
+		{"host", func(r *http.Request) []byte { r.Host = "other.example"; return body }, nil},
+		{"date", func(r *http.Request) []byte {
+			r.Header.Set("Date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+			return body
+		}, nil},
+		{"stale date", func(r *http.Request) []byte {
+			r.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			return body
+		}, errStaleDate},
+		{"unsigned date", func(r *http.Request) []byte {
+			resign(t, r, []string{"(request-target)", "host", "digest"})
+			return body
+		}, errUnsigned},
+		{"unsigned target", func(r *http.Request) []byte {
+			resign(t, r, []string{"host", "date", "digest"})
+			return body
+		}, errUnsigned},
+		{"unsigned host", func(r *http.Request) []byte {
+			resign(t, r, []string{"(request-target)", "date", "digest"})
+			return body
+		}, errUnsigned},
+		{"unsigned digest", func(r *http.Request) []byte {
+			resign(t, r, []string{"(request-target)", "host", "date"})
+			return body
+		}, errUnsigned},
+		{"no signature", func(r *http.Request) []byte { r.Header.Del("Signature"); return body }, errNoSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedInboxRequest(t, body)
+			b := tt.tamper(r)
+			_, err := verifyRequest(r, b, lookupTestKey)
+			if err == nil {
+				t.Fatal("tampered request accepted")
+			}
+			if tt.want != nil && err != tt.want {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestWrongKey(t *testing.T) {
+	body := []byte(`{}`)
+	r := signedInboxRequest(t, body)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyRequest(r, body, func(string) (*rsa.PublicKey, error) { return &other.PublicKey, nil })
+	if err == nil {
+		t.Fatal("signature verified with the wrong key")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// UI strings are looked up by key in a per-locale catalog. The locale of a
+// request is, in order: the logged-in user's choice, the choice stored in
+// the session, the best match in Accept-Language, and defaultLocale.
+//
+// Post lists that are cached, on the index and user pages, are rendered
+// once per locale. Relative timestamps in them are filled in by
+// jquery.timeago in the browser, with the strings of the page's locale.
+
+type locale string
+
+const (
+	localeJa      locale = "ja"
+	localeEn      locale = "en"
+	defaultLocale        = localeJa
+)
+
+var locales = []locale{localeJa, localeEn}
+
+var catalog = map[locale]map[string]string{
+	localeJa: {
+		"locale.name":      "日本語",
+		"nav.login":        "ログイン",
+		"nav.admin":        "管理者用ページ",
+		"nav.logout":       "ログアウト",
+		"user.suffix":      "さん",
+		"user.page":        "のページ",
+		"user.posts":       "投稿数",
+		"user.comments":    "コメント数",
+		"user.commented":   "被コメント数",
+		"index.more":       "もっと見る",
+		"form.account":     "アカウント名",
+		"form.password":    "パスワード",
+		"login.title":      "ログイン",
+		"login.failed":     "アカウント名かパスワードが間違っています",
+		"register.link":    "ユーザー登録",
+		"register.title":   "ユーザー登録",
+		"register.invalid": "アカウント名は3文字以上、パスワードは6文字以上である必要があります",
+		"register.taken":   "アカウント名がすでに使われています",
+		"post.no_image":    "画像が必須です",
+		"post.bad_mime":    "投稿できる画像形式はjpgとpngとgifだけです",
+		"post.too_large":   "ファイルサイズが大きすぎます",
+		"post.comments":    "コメント",
+	},
+	localeEn: {
+		"locale.name":      "English",
+		"nav.login":        "Log in",
+		"nav.admin":        "Admin",
+		"nav.logout":       "Log out",
+		"user.suffix":      "",
+		"user.page":        "'s page",
+		"user.posts":       "Posts",
+		"user.comments":    "Comments",
+		"user.commented":   "Comments received",
+		"index.more":       "Load more",
+		"form.account":     "Account name",
+		"form.password":    "Password",
+		"login.title":      "Log in",
+		"login.failed":     "Wrong account name or password",
+		"register.link":    "Sign up",
+		"register.title":   "Sign up",
+		"register.invalid": "Account names need at least 3 characters and passwords at least 6",
+		"register.taken":   "That account name is already taken",
+		"post.no_image":    "An image is required",
+		"post.bad_mime":    "Only jpg, png and gif images can be posted",
+		"post.too_large":   "The file is too large",
+		"post.comments":    "comments",
+	},
+}
+
+// timeagoStrings are jquery.timeago's settings.strings per locale.
+var timeagoStrings = map[locale]map[string]string{
+	localeJa: {
+		"prefixAgo": "", "prefixFromNow": "今から", "suffixAgo": "前", "suffixFromNow": "後",
+		"seconds": "1 分未満", "minute": "約 1 分", "minutes": "%d 分",
+		"hour": "約 1 時間", "hours": "約 %d 時間", "day": "約 1 日", "days": "約 %d 日",
+		"month": "約 1 ヶ月", "months": "約 %d ヶ月", "year": "約 1 年", "years": "約 %d 年",
+		"wordSeparator": "",
+	},
+	localeEn: {
+		"prefixAgo": "", "prefixFromNow": "", "suffixAgo": "ago", "suffixFromNow": "from now",
+		"seconds": "less than a minute", "minute": "about a minute", "minutes": "%d minutes",
+		"hour": "about an hour", "hours": "about %d hours", "day": "a day", "days": "%d days",
+		"month": "about a month", "months": "%d months", "year": "about a year", "years": "%d years",
+		"wordSeparator": " ",
+	},
+}
+
+// timeagoJSON holds timeagoStrings encoded for a <script> element.
+var timeagoJSON = func() map[locale]string {
+	m := make(map[locale]string, len(locales))
+	for _, l := range locales {
+		b, err := json.Marshal(timeagoStrings[l])
+		if err != nil {
+			panic(err)
+		}
+		m[l] = string(b)
+	}
+	return m
+}()
+
+// T returns the message for key. Unknown keys, such as notices stored in
+// sessions before they became keys, are returned as they are.
+func (l locale) T(key string) string {
+	if s, ok := catalog[l][key]; ok {
+		return s
+	}
+	if s, ok := catalog[defaultLocale][key]; ok {
+		return s
+	}
+	return key
+}
+
+func parseLocale(s string) (locale, bool) {
+	tag, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "-")
+	for _, l := range locales {
+		if string(l) == tag {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+// acceptedLocale picks the supported locale with the highest weight in
+// Accept-Language.
+func acceptedLocale(header string) (locale, bool) {
+	best, bestQ := locale(""), 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if l, ok := parseLocale(tag); ok && q > bestQ {
+			best, bestQ = l, q
+		}
+	}
+	return best, best != ""
+}
+
+// requestLocale returns the locale to render the response to r in.
+func requestLocale(r *http.Request, me User) locale {
+	if l, ok := parseLocale(me.Locale); ok {
+		return l
+	}
+	if l, ok := parseLocale(getSession(r).Locale); ok {
+		return l
+	}
+	if l, ok := acceptedLocale(r.Header.Get("Accept-Language")); ok {
+		return l
+	}
+	return defaultLocale
+}
+
+// pageLocale returns the locale to render the page for r in. The response
+// is marked as depending on Accept-Language, which the locale may come from.
+func pageLocale(w http.ResponseWriter, r *http.Request, me User) locale {
+	w.Header().Add("Vary", "Accept-Language")
+	return requestLocale(r, me)
+}
+
+// postLocale stores the chosen locale in the session and, for a logged-in
+// user, in their account, then goes back to the page it was chosen on.
+func postLocale(w http.ResponseWriter, r *http.Request) {
+	// Every page gives the session a token (see pageCSRFToken), so a
+	// session without one did not come from the form.
+	if token := getCSRFToken(r); token == "" || r.FormValue("csrf_token") != token {
+		w.WriteHeader(StatusUnprocessableEntity)
+		return
+	}
+	l, ok := parseLocale(r.FormValue("locale"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	me := getSessionUser(r)
+	if isLogin(me) {
+		if err := setUserLocale(r.Context(), me.ID, string(l)); err != nil {
+			reqLogger(r).Error("failed to save locale", "user_id", me.ID, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	session := getSession(r)
+	session.Locale = string(l)
+	session.Save(r, w)
+
+	// Only follow the path of the referer, never to another host.
+	back := "/"
+	if u, err := url.Parse(r.Referer()); err == nil && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") {
+		back = u.Path
+		if u.RawQuery != "" {
+			back += "?" + u.RawQuery
+		}
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
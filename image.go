@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Images never change once posted, so they are served with a strong ETag
+// (the SHA-256 of the file) and cached by clients for a year. Posts from the
+// initial data set keep their image in posts.imgdata; it is written out to
+// config.PublicDir on first request and served from disk from then on.
+//
+// With image_accel_prefix set, the handler only sets headers and
+// X-Accel-Redirect: <prefix>/<file>, leaving the transfer to nginx, e.g.
+//
+//	location /_image/ { internal; alias /home/isucon/public/image/; }
+
+const imageCacheControl = "public, max-age=31536000, immutable"
+
+var extMimes = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+	"gif": "image/gif",
+}
+
+type imageETagKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// imageETags caches file hashes, so each image is read for hashing once.
+var imageETags sync.Map // imageETagKey -> string
+
+func imageETag(path string, f *os.File, st os.FileInfo) (string, error) {
+	key := imageETagKey{path, st.Size(), st.ModTime()}
+	if etag, ok := imageETags.Load(key); ok {
+		return etag.(string), nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	imageETags.Store(key, etag)
+	return etag, nil
+}
+
+// writeImage saves an image loaded from the DB to path, atomically so that
+// concurrent requests never see a partial file.
+func writeImage(path string, data []byte) error {
+	tf, err := os.CreateTemp(filepath.Dir(path), ".img-")
+	if err != nil {
+		return err
+	}
+	_, err = tf.Write(data)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tf.Name(), 0666)
+	}
+	if err == nil {
+		err = os.Rename(tf.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+	}
+	return err
+}
+
+// openImage opens the file of post pid, writing it out from the DB first
+// if needed. It returns os.ErrNotExist when the post has no such image.
+func openImage(r *http.Request, pid int, mime string) (*os.File, error) {
+	path := imagePath(pid, mime)
+	f, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+
+	post := Post{}
+	err = db.GetContext(r.Context(), &post, "SELECT `mime`, `imgdata` FROM `posts` WHERE `id` = ?", pid)
+	if err != nil || post.Mime != mime || len(post.Imgdata) == 0 {
+		if err != nil && err != sql.ErrNoRows {
+			reqLogger(r).Error("failed to get image", "post_id", pid, "err", err)
+		}
+		return nil, os.ErrNotExist
+	}
+	if err := writeImage(path, post.Imgdata); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func getImage(c web.C, w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(c.URLParams["id"])
+	mime, ok := extMimes[c.URLParams["ext"]]
+	if err != nil || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := openImage(r, pid, mime)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqLogger(r).Error("failed to open image", "post_id", pid, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err == nil {
+		var etag string
+		if etag, err = imageETag(f.Name(), f, st); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	if err != nil {
+		reqLogger(r).Error("failed to read image", "post_id", pid, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", mime)
+	h.Set("Cache-Control", imageCacheControl)
+	if config.ImageAccelPrefix != "" {
+		h.Set("X-Accel-Redirect", config.ImageAccelPrefix+"/"+filepath.Base(f.Name()))
+		return
+	}
+	http.ServeContent(w, r, "", st.ModTime(), f)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Cross-instance cache invalidation. Every instance publishes what it
+// changed and drops or reloads the same entries when another instance
+// does. Two backends are supported (config.CacheBus):
+//
+//	db     instances poll the cache_changes table every cache_bus_poll
+//	redis  Redis pub/sub on redis_addr; after a reconnect, when messages
+//	       may have been lost, all caches are rebuilt
+//
+// Either way caches converge within about one poll interval or one
+// reconnect. Invalidations are idempotent, so applying one twice is safe.
+
+const (
+	invalidateUser     = "user"     // Ref is the user ID
+	invalidateComments = "comments" // Ref is the post ID
+	invalidateProfile  = "profile"  // Ref is the user ID
+	invalidateIndex    = "index"
+	invalidateAll      = "all"
+
+	redisInvalidateChannel = "isuconp:invalidate"
+
+	// cacheChangesOverlap is how far behind its cursor the poller reads
+	// again, for rows whose auto-increment ID was assigned before, but
+	// committed after, a higher one.
+	cacheChangesOverlap = 100
+	cacheChangesTTL     = 10 * time.Minute
+)
+
+type cacheEvent struct {
+	Origin string `json:"o"`
+	Kind   string `json:"k"`
+	Ref    int    `json:"r,omitempty"`
+}
+
+type cacheBusBackend interface {
+	publish(ctx context.Context, ev cacheEvent) error
+	// run delivers events published by other instances until ctx is done.
+	run(ctx context.Context, apply func([]cacheEvent))
+}
+
+var (
+	instanceID = secureRandomStr(8)
+	cacheBus   cacheBusBackend
+)
+
+// openCacheBus connects the configured backend for publishing. Servers
+// then call runCacheBus to receive.
+func openCacheBus() error {
+	switch config.CacheBus {
+	case "":
+	case "db":
+		cacheBus = &dbCacheBus{interval: time.Duration(config.CacheBusPoll)}
+	case "redis":
+		cacheBus = newRedisCacheBus(config.RedisAddr)
+	default:
+		return fmt.Errorf("cache bus: unknown backend %s", config.CacheBus)
+	}
+	return nil
+}
+
+func runCacheBus(ctx context.Context) {
+	if cacheBus != nil {
+		go cacheBus.run(ctx, applyInvalidations)
+	}
+}
+
+// publishInvalidation tells the other instances that the cached kind/ref
+// has changed. The change is already committed, so it is published even if
+// ctx has been canceled.
+func publishInvalidation(ctx context.Context, kind string, ref int) {
+	if cacheBus == nil {
+		return
+	}
+	err := cacheBus.publish(context.WithoutCancel(ctx), cacheEvent{Origin: instanceID, Kind: kind, Ref: ref})
+	if err != nil {
+		ctxLogger(ctx).Error("failed to publish cache invalidation", "kind", kind, "ref", ref, "err", err)
+		return
+	}
+	cacheInvalidations.WithLabelValues(kind, "sent").Inc()
+}
+
+// applyInvalidations drops the entries named by evs. The index is
+// re-rendered once, after everything else.
+func applyInvalidations(evs []cacheEvent) {
+	ctx := context.Background()
+	index := false
+	for _, ev := range evs {
+		if ev.Origin == instanceID {
+			continue
+		}
+		cacheInvalidations.WithLabelValues(ev.Kind, "received").Inc()
+		switch ev.Kind {
+		case invalidateUser:
+			userStore.remove(ev.Ref)
+			profiles.remove(ev.Ref)
+		case invalidateProfile:
+			profiles.remove(ev.Ref)
+		case invalidateComments:
+			commentCache.remove(ev.Ref)
+		case invalidateIndex:
+			index = true
+		case invalidateAll:
+			if err := rebuildCaches(ctx); err != nil {
+				slog.Error("failed to rebuild caches", "err", err)
+			}
+			index = false
+		default:
+			slog.Warn("unknown cache invalidation", "kind", ev.Kind, "origin", ev.Origin)
+		}
+	}
+	if index {
+		renderIndexPosts(ctx)
+	}
+}
+
+// dbCacheBus appends events to cache_changes and polls it.
+type dbCacheBus struct {
+	interval time.Duration
+}
+
+func (b *dbCacheBus) publish(ctx context.Context, ev cacheEvent) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO `cache_changes` (`origin`, `kind`, `ref`) VALUES (?,?,?)", ev.Origin, ev.Kind, ev.Ref)
+	return err
+}
+
+func (b *dbCacheBus) run(ctx context.Context, apply func([]cacheEvent)) {
+	var cursor int64
+	if err := db.GetContext(ctx, &cursor, "SELECT COALESCE(MAX(`id`), 0) FROM `cache_changes`"); err != nil {
+		slog.Error("failed to read cache_changes", "err", err)
+	}
+	seen := make(map[int64]bool)
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		var rows []struct {
+			ID     int64  `db:"id"`
+			Origin string `db:"origin"`
+			Kind   string `db:"kind"`
+			Ref    int    `db:"ref"`
+		}
+		err := db.SelectContext(ctx, &rows, "SELECT `id`, `origin`, `kind`, `ref` FROM `cache_changes` WHERE `id` > ? ORDER BY `id`",
+			cursor-cacheChangesOverlap)
+		if err != nil {
+			slog.Error("failed to poll cache_changes", "err", err)
+			continue
+		}
+		var evs []cacheEvent
+		for _, r := range rows {
+			if r.ID > cursor {
+				cursor = r.ID
+			}
+			if seen[r.ID] {
+				continue
+			}
+			seen[r.ID] = true
+			evs = append(evs, cacheEvent{Origin: r.Origin, Kind: r.Kind, Ref: r.Ref})
+		}
+		for id := range seen {
+			if id <= cursor-cacheChangesOverlap {
+				delete(seen, id)
+			}
+		}
+		if len(evs) > 0 {
+			apply(evs)
+		}
+
+		if time.Since(lastCleanup) > cacheChangesTTL {
+			lastCleanup = time.Now()
+			_, err := db.ExecContext(ctx, "DELETE FROM `cache_changes` WHERE `created_at` < ?", lastCleanup.Add(-cacheChangesTTL))
+			if err != nil {
+				slog.Error("failed to clean up cache_changes", "err", err)
+			}
+		}
+	}
+}
+
+// redisCacheBus publishes events as JSON on a Redis channel.
+type redisCacheBus struct {
+	addr string
+	pool *redis.Pool
+}
+
+func newRedisCacheBus(addr string) *redisCacheBus {
+	return &redisCacheBus{
+		addr: addr,
+		pool: &redis.Pool{
+			MaxIdle:     4,
+			IdleTimeout: time.Minute,
+			Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		},
+	}
+}
+
+func (b *redisCacheBus) publish(ctx context.Context, ev cacheEvent) error {
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	conn, err := b.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", redisInvalidateChannel, msg)
+	return err
+}
+
+func (b *redisCacheBus) run(ctx context.Context, apply func([]cacheEvent)) {
+	backoff := dbWaitMinInterval
+	connected := false
+	for ctx.Err() == nil {
+		conn, err := redis.Dial("tcp", b.addr)
+		if err == nil {
+			psc := redis.PubSubConn{Conn: conn}
+			err = psc.Subscribe(redisInvalidateChannel)
+			if err == nil && connected {
+				// Anything published while we were away is lost.
+				apply([]cacheEvent{{Kind: invalidateAll}})
+			}
+			connected = true
+			backoff = dbWaitMinInterval
+			for err == nil {
+				switch v := psc.Receive().(type) {
+				case redis.Message:
+					var ev cacheEvent
+					if jerr := json.Unmarshal(v.Data, &ev); jerr != nil {
+						slog.Warn("bad cache invalidation message", "err", jerr)
+						continue
+					}
+					apply([]cacheEvent{ev})
+				case error:
+					err = v
+				}
+			}
+			conn.Close()
+		}
+		slog.Error("cache bus: redis subscription lost", "addr", b.addr, "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > dbWaitMaxInterval {
+			backoff = dbWaitMaxInterval
+		}
+	}
+}
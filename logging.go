@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zenazn/goji/web"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+var (
+	reqIDPrefix  = secureRandomStr(4)
+	reqIDCounter uint64
+)
+
+// initLogger installs the default logger. format is "json" or "text" and
+// level is one of debug, info, warn and error. Messages from the standard
+// log package go through the same handler.
+func initLogger(format, level string) {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		lv = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+
+	var h slog.Handler
+	if strings.EqualFold(format, "json") {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newRequestID() string {
+	return reqIDPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&reqIDCounter, 1), 10)
+}
+
+// requestIDMiddleware assigns every request an ID, taken from X-Request-ID
+// when the reverse proxy sets one, and stores a logger carrying it in the
+// request context.
+func requestIDMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		l := slog.Default().With("request_id", id, "method", r.Method, "path", r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// ctxLogger returns the request logger stored in ctx, or the default logger.
+func ctxLogger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func reqLogger(r *http.Request) *slog.Logger {
+	return ctxLogger(r.Context())
+}
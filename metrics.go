@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isucon_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isucon_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isucon_db_query_duration_seconds",
+		Help:    "DB statement latency by statement verb.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isucon_db_query_errors_total",
+		Help: "DB statements that returned an error, by statement verb.",
+	}, []string{"op"})
+
+	indexRenders = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_index_renders_total",
+		Help: "Times the index post list was re-rendered.",
+	})
+	indexRenderDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "isucon_index_render_duration_seconds",
+		Help:    "Time spent re-rendering the index post list.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	uploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "isucon_upload_bytes",
+		Help:    "Size of accepted image uploads.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 2, 10),
+	})
+	uploadRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isucon_upload_rejections_total",
+		Help: "Rejected image uploads by reason.",
+	}, []string{"reason"})
+
+	commentCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_comment_cache_hits_total",
+		Help: "Comment lists served from the cache.",
+	})
+	commentCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_comment_cache_misses_total",
+		Help: "Comment lists loaded from the DB.",
+	})
+	commentCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_comment_cache_evictions_total",
+		Help: "Posts evicted from the comment cache to stay under its memory limit.",
+	})
+	profileCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_profile_cache_hits_total",
+		Help: "User pages served from the cache.",
+	})
+	profileCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "isucon_profile_cache_misses_total",
+		Help: "User pages rendered from the DB.",
+	})
+	cacheInvalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isucon_cache_invalidations_total",
+		Help: "Cache invalidations sent to and received from other instances, by kind.",
+	}, []string{"kind", "direction"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests, httpDuration,
+		dbDuration, dbErrors,
+		indexRenders, indexRenderDuration,
+		uploadBytes, uploadRejections,
+		commentCacheHits, commentCacheMisses, commentCacheEvictions,
+		profileCacheHits, profileCacheMisses,
+		cacheInvalidations,
+	)
+	prometheus.MustRegister(
+		cacheSizeFunc("comments", func() int {
+			n, _ := commentCache.stats()
+			return n
+		}),
+		cacheSizeFunc("users", userStore.len),
+		cacheSizeFunc("profiles", profiles.len),
+		cacheSizeFunc("sessions", func() int {
+			sessionStore.Lock()
+			defer sessionStore.Unlock()
+			return len(sessionStore.store)
+		}),
+	)
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "isucon_comment_cache_bytes",
+		Help: "Estimated memory held by the comment cache.",
+	}, func() float64 {
+		_, b := commentCache.stats()
+		return float64(b)
+	}))
+
+	queryHooks = append(queryHooks, observeQuery)
+}
+
+func cacheSizeFunc(name string, f func() int) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "isucon_cache_entries",
+		Help:        "Entries in the in-process caches.",
+		ConstLabels: prometheus.Labels{"cache": name},
+	}, func() float64 { return float64(f()) })
+}
+
+// queryOp returns the lower-cased verb of a SQL statement.
+func queryOp(query string) string {
+	query = strings.TrimSpace(query)
+	if i := strings.IndexAny(query, " \t\n"); i > 0 {
+		query = query[:i]
+	}
+	return strings.ToLower(query)
+}
+
+func observeQuery(ctx context.Context, query string, d time.Duration, err error) {
+	op := queryOp(query)
+	dbDuration.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// routePattern returns the goji pattern that matched the request. It needs
+// the Mux.Router middleware to run first.
+func routePattern(c *web.C) string {
+	m := web.GetMatch(*c)
+	if m.Pattern == nil {
+		return "NotFound"
+	}
+	return fmt.Sprint(m.RawPattern())
+}
+
+func metricsMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := mutil.WrapWriter(w)
+		h.ServeHTTP(ww, r)
+
+		route := routePattern(c)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+	return http.HandlerFunc(fn)
+}
+
+var metricsHandler = promhttp.Handler()
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations live in migrations/ as NNNN_name.up.sql and
+// NNNN_name.down.sql and are compiled into the binary. Applied versions are
+// recorded in schema_migrations. MySQL commits DDL implicitly, so a failed
+// migration can leave its earlier statements applied: keep each file
+// idempotent (IF [NOT] EXISTS) so that it can simply be run again. The
+// initial schema has no down migration, so that rolling back can never
+// drop the users, posts and comments.
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+const (
+	migrationTable = "schema_migrations"
+	migrationLock  = "isuconp_migrate"
+)
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations returns the embedded migrations ordered by version.
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		m := migrationFileRegexp.FindStringSubmatch(path.Base(f))
+		if m == nil {
+			return nil, fmt.Errorf("migrate: bad file name %s", f)
+		}
+		v, _ := strconv.Atoi(m[1])
+		b, err := migrationFS.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		mg := byVersion[v]
+		if mg == nil {
+			mg = &migration{Version: v, Name: m[2]}
+			byVersion[v] = mg
+		} else if mg.Name != m[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by %s and %s", v, mg.Name, m[2])
+		}
+		if m[3] == "up" {
+			mg.Up = string(b)
+		} else {
+			mg.Down = string(b)
+		}
+	}
+
+	ms := make([]migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("migrate: %04d_%s has no up migration", mg.Version, mg.Name)
+		}
+		ms = append(ms, *mg)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// splitStatements splits a migration file into statements at semicolons
+// ending a line, dropping -- comments.
+func splitStatements(sql string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		t := strings.TrimSpace(line)
+		if t == "" || strings.HasPrefix(t, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+		if strings.HasSuffix(t, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(cur.String()), ";"))
+			cur.Reset()
+		}
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+func ensureMigrationTable(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `"+migrationTable+"` ("+
+		"`version` int NOT NULL PRIMARY KEY,"+
+		"`name` varchar(255) NOT NULL,"+
+		"`applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP"+
+		") DEFAULT CHARSET=utf8mb4")
+	return err
+}
+
+// appliedMigrations returns the versions recorded in the migration table.
+func appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := db.SelectContext(ctx, &rows, "SELECT `version`, `applied_at` FROM `"+migrationTable+"`"); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// pendingMigrations returns the migrations that have not been applied yet.
+func pendingMigrations(ctx context.Context) ([]migration, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// withMigrationLock runs f holding a MySQL named lock, so that two
+// instances starting together do not migrate at once.
+func withMigrationLock(ctx context.Context, f func() error) error {
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var got int
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLock).Scan(&got); err != nil {
+		return err
+	}
+	if got != 1 {
+		return fmt.Errorf("migrate: timed out waiting for lock %s", migrationLock)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLock)
+	return f()
+}
+
+func runMigration(ctx context.Context, m migration, up bool) error {
+	sql, dir := m.Up, "up"
+	if !up {
+		sql, dir = m.Down, "down"
+	}
+	for _, stmt := range splitStatements(sql) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate: %04d_%s %s: %v", m.Version, m.Name, dir, err)
+		}
+	}
+	var err error
+	if up {
+		_, err = db.ExecContext(ctx, "INSERT INTO `"+migrationTable+"` (`version`, `name`) VALUES (?, ?)", m.Version, m.Name)
+	} else {
+		_, err = db.ExecContext(ctx, "DELETE FROM `"+migrationTable+"` WHERE `version` = ?", m.Version)
+	}
+	if err == nil {
+		slog.Info("migrated", "version", m.Version, "name", m.Name, "direction", dir)
+	}
+	return err
+}
+
+// migrateUp applies every pending migration in order.
+func migrateUp(ctx context.Context) error {
+	return withMigrationLock(ctx, func() error {
+		pending, err := pendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			if err := runMigration(ctx, m, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateDown reverts the n most recently applied migrations.
+func migrateDown(ctx context.Context, n int) error {
+	return withMigrationLock(ctx, func() error {
+		ms, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+		if err := ensureMigrationTable(ctx); err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(ms) - 1; i >= 0 && n > 0; i-- {
+			m := ms[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migrate: %04d_%s has no down migration", m.Version, m.Name)
+			}
+			if err := runMigration(ctx, m, false); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+// printMigrationStatus lists every migration and when it was applied.
+func printMigrationStatus(ctx context.Context, w io.Writer) error {
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationTable(ctx); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		status := "pending"
+		if t, ok := applied[m.Version]; ok {
+			status = t.Format(ISO8601_FORMAT)
+		}
+		fmt.Fprintf(w, "%04d_%-24s %s\n", m.Version, m.Name, status)
+	}
+	return nil
+}
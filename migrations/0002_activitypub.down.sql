@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `ap_following`;
+DROP TABLE IF EXISTS `ap_followers`;
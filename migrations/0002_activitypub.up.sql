@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS `ap_followers` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `actor` varchar(255) NOT NULL,
+  `inbox` varchar(255) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `user_actor` (`user_id`, `actor`)
+) DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `ap_following` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `actor` varchar(255) NOT NULL,
+  `inbox` varchar(255) NOT NULL,
+  `accepted` tinyint NOT NULL DEFAULT 0,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `user_actor` (`user_id`, `actor`)
+) DEFAULT CHARSET=utf8mb4;
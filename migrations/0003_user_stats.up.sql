@@ -0,0 +1,15 @@
+-- Per-user counters shown on the profile page, maintained by the app when
+-- posts and comments are added and rebuilt by `app recount`.
+CREATE TABLE IF NOT EXISTS `user_stats` (
+  `user_id` int NOT NULL PRIMARY KEY,
+  `post_count` int NOT NULL DEFAULT 0,
+  `comment_count` int NOT NULL DEFAULT 0,
+  `commented_count` int NOT NULL DEFAULT 0
+) DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO `user_stats` (`user_id`, `post_count`, `comment_count`, `commented_count`)
+SELECT u.`id`, COALESCE(p.`n`, 0), COALESCE(c.`n`, 0), COALESCE(r.`n`, 0)
+FROM `users` u
+LEFT JOIN (SELECT `user_id`, COUNT(*) AS `n` FROM `posts` GROUP BY `user_id`) p ON p.`user_id` = u.`id`
+LEFT JOIN (SELECT `user_id`, COUNT(*) AS `n` FROM `comments` GROUP BY `user_id`) c ON c.`user_id` = u.`id`
+LEFT JOIN (SELECT posts.`user_id`, COUNT(*) AS `n` FROM `comments` INNER JOIN `posts` ON comments.`post_id` = posts.`id` GROUP BY posts.`user_id`) r ON r.`user_id` = u.`id`;
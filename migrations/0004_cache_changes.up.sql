@@ -0,0 +1,9 @@
+-- Change log polled by instances running with cache_bus = "db".
+CREATE TABLE IF NOT EXISTS `cache_changes` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `origin` varchar(32) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `ref` int NOT NULL DEFAULT 0,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `created_at` (`created_at`)
+) DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+-- UI language chosen by the user; empty follows Accept-Language.
+ALTER TABLE `users` ADD COLUMN `locale` varchar(8) NOT NULL DEFAULT '';
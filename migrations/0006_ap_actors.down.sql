@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `ap_activities`;
+DROP TABLE IF EXISTS `ap_actors`;
@@ -0,0 +1,14 @@
+-- Shadow users of remote actors, keyed by actor IRI.
+CREATE TABLE IF NOT EXISTS `ap_actors` (
+  `actor` varchar(255) NOT NULL PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `user_id` (`user_id`)
+) DEFAULT CHARSET=utf8mb4;
+
+-- IDs of inbox activities already processed, kept to refuse replays.
+CREATE TABLE IF NOT EXISTS `ap_activities` (
+  `id` varchar(255) NOT NULL PRIMARY KEY,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY `created_at` (`created_at`)
+) DEFAULT CHARSET=utf8mb4;
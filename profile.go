@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"html"
+	"strings"
+	"sync"
+)
+
+// User pages (/@account) are cached per user: the counters, and the post
+// list as rendered HTML. A user's page is dropped when they post, comment
+// or are banned, or when someone comments on one of their posts, and is
+// rendered again on the next visit.
+//
+// The post list is rendered once per locale. The viewer-specific parts are
+// filled in per request: the layout and the localised header around the
+// post list, and the CSRF token of every comment form at the points the
+// fragment was split at (see profileFragment).
+
+// profileCSRFMarker is rendered in place of the CSRF token. It is random so
+// that a post body cannot contain it.
+var profileCSRFMarker = "csrf-" + secureRandomStr(16)
+
+type profileFragment struct {
+	user  User
+	stats userStats
+	parts map[locale][][]byte // the post list split at every CSRF token
+}
+
+// html returns the post list in loc with token in its comment forms.
+func (f *profileFragment) html(loc locale, token string) string {
+	parts := f.parts[loc]
+	token = html.EscapeString(token)
+	n := len(token) * (len(parts) - 1)
+	for _, p := range parts {
+		n += len(p)
+	}
+	var b strings.Builder
+	b.Grow(n)
+	for i, p := range parts {
+		if i > 0 {
+			b.WriteString(token)
+		}
+		b.Write(p)
+	}
+	return b.String()
+}
+
+type profileCache struct {
+	sync.RWMutex
+	byID   map[int]*profileFragment
+	byName map[string]int
+	// version changes on every remove, so that a render racing with an
+	// invalidation does not cache the old page.
+	version uint64
+}
+
+var profiles = &profileCache{byID: make(map[int]*profileFragment), byName: make(map[string]int)}
+
+func (c *profileCache) get(accountName string) (*profileFragment, uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	f, ok := c.byID[c.byName[accountName]]
+	return f, c.version, ok
+}
+
+// put stores f unless something was removed since version was read.
+func (c *profileCache) put(f *profileFragment, version uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.version != version {
+		return
+	}
+	c.byID[f.user.ID] = f
+	c.byName[f.user.AccountName] = f.user.ID
+}
+
+func (c *profileCache) remove(uid int) {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	if f, ok := c.byID[uid]; ok {
+		delete(c.byName, f.user.AccountName)
+		delete(c.byID, uid)
+	}
+}
+
+func (c *profileCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	c.byID = make(map[int]*profileFragment)
+	c.byName = make(map[string]int)
+}
+
+func (c *profileCache) len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.byID)
+}
+
+// invalidateProfiles drops the pages of uids here and on the other
+// instances.
+func invalidateProfiles(ctx context.Context, uids ...int) {
+	for _, uid := range uids {
+		profiles.remove(uid)
+		publishInvalidation(ctx, invalidateProfile, uid)
+	}
+}
+
+// loadProfile returns the page of accountName, rendering it on a miss. It
+// returns nil if there is no such user or the user is banned.
+func loadProfile(ctx context.Context, accountName string) (*profileFragment, error) {
+	f, version, ok := profiles.get(accountName)
+	if ok {
+		profileCacheHits.Inc()
+		return f, nil
+	}
+	profileCacheMisses.Inc()
+
+	user := User{}
+	err := db.GetContext(ctx, &user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Post{}
+	err = db.SelectContext(ctx, &results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, config.PostsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].User = user
+	}
+	posts, err := makePosts(ctx, results, profileCSRFMarker, false, config.PostsPerPage)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := getUserStats(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	f = &profileFragment{user: user, stats: stats, parts: make(map[locale][][]byte, len(locales))}
+	for _, l := range locales {
+		var b bytes.Buffer
+		traceRender(ctx, "posts", func() { views.writePostList(&b, l, posts) })
+		f.parts[l] = bytes.Split(b.Bytes(), []byte(profileCSRFMarker))
+	}
+	profiles.put(f, version)
+	return f, nil
+}
@@ -1,10 +1,20 @@
 #!/bin/bash
 
+go get "github.com/andybalholm/brotli"
 go get "github.com/bradfitz/gomemcache/memcache"
 go get "github.com/bradleypeabody/gorilla-sessions-memcache"
 go get "github.com/go-sql-driver/mysql"
+go get "github.com/gomodule/redigo/redis"
 go get "github.com/gorilla/sessions"
 go get "github.com/jmoiron/sqlx"
+go get "github.com/klauspost/compress"
+go get "github.com/prometheus/client_golang/prometheus"
+go get "github.com/valyala/quicktemplate"
 go get "github.com/zenazn/goji"
+go get "go.opentelemetry.io/otel"
+go get "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+go get "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+go get "go.opentelemetry.io/otel/sdk"
 
+go generate
 go build -o app
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zenazn/goji/graceful"
+)
+
+// Graceful shutdown and zero-downtime restart.
+//
+// SIGTERM and SIGINT stop accepting connections and wait up to
+// shutdownTimeout for in-flight requests, uploads included, before exiting.
+//
+// SIGUSR2 hands the listening sockets to a freshly exec'd copy of the binary
+// (as fd 3 and 4, like systemd socket activation) and shuts down once the
+// child reports ready on fd 5. Running under a systemd .socket unit works
+// without this, since goji's bind picks up fd@3 from LISTEN_FDS.
+//
+// The child starts from the sessions saved at the handoff, but the parent
+// keeps changing sessions while its requests drain. It saves them again
+// before exiting, and the child, which sees the parent exit as EOF on fd 6,
+// then takes from the file every session it has not changed itself.
+
+const (
+	inheritedAppFD   = 3
+	inheritedDebugFD = 4
+	readyFD          = 5
+	parentFD         = 6
+
+	readyFDEnv  = "ISUCONP_READY_FD"
+	debugFDEnv  = "ISUCONP_DEBUG_FD"
+	parentFDEnv = "ISUCONP_PARENT_FD"
+
+	handoffTimeout = time.Minute
+)
+
+var (
+	shutdownTimeout = 30 * time.Second
+	sessionFile     string
+
+	appListener   net.Listener
+	debugListener net.Listener
+	debugServer   *http.Server
+
+	// exitPipe is held open until the process exits, so the child of a
+	// handoff reads EOF once the sessions have been saved for the last time.
+	exitPipe *os.File
+
+	shutdownHooks []func()
+)
+
+// onShutdown registers f to run after in-flight requests have drained.
+func onShutdown(f func()) {
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// listenDebug opens the pprof listener, reusing the one passed by a parent
+// process during a restart.
+func listenDebug(addr string) (net.Listener, error) {
+	if s := os.Getenv(debugFDEnv); s != "" {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		return net.FileListener(os.NewFile(uintptr(fd), "debug"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveDebug(addr string, h http.Handler) {
+	l, err := listenDebug(addr)
+	if err != nil {
+		slog.Error("failed to listen for debug server", "addr", addr, "err", err)
+		return
+	}
+	debugListener = l
+	debugServer = &http.Server{Handler: h}
+	go func() {
+		if err := debugServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("debug server stopped", "err", err)
+		}
+	}()
+}
+
+// setupGracefulShutdown must be called before serving l.
+func setupGracefulShutdown(l net.Listener) {
+	appListener = l
+	graceful.AddSignal(syscall.SIGTERM)
+	graceful.Timeout(shutdownTimeout)
+	graceful.PreHook(func() {
+		slog.Info("shutting down", "timeout", shutdownTimeout)
+		if debugServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			debugServer.Shutdown(ctx)
+		}
+	})
+	graceful.PostHook(func() {
+		for _, f := range shutdownHooks {
+			f()
+		}
+		slog.Info("shutdown complete")
+	})
+
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := handoff(); err != nil {
+				slog.Error("restart failed; still serving", "err", err)
+				continue
+			}
+			slog.Info("restart: child is ready, draining")
+			go func() {
+				time.Sleep(shutdownTimeout)
+				graceful.ShutdownNow()
+			}()
+			graceful.Shutdown()
+			return
+		}
+	}()
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// handoff starts a copy of this process on the same sockets and waits for it
+// to become ready.
+func handoff() error {
+	af, ok := appListener.(filer)
+	if !ok {
+		return errors.New("restart: listener cannot be passed to a child")
+	}
+	appFile, err := af.File()
+	if err != nil {
+		return err
+	}
+	defer appFile.Close()
+
+	// Keep the fd numbers fixed: a missing debug listener is replaced by
+	// /dev/null.
+	debugFile, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	if df, ok := debugListener.(filer); ok {
+		debugFile.Close()
+		if debugFile, err = df.File(); err != nil {
+			return err
+		}
+	}
+	defer debugFile.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	er, ew, err := os.Pipe()
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	defer er.Close()
+
+	saveSessions()
+
+	exe, err := os.Executable()
+	if err != nil {
+		pw.Close()
+		ew.Close()
+		return err
+	}
+	args := childArgs(os.Args[1:], "-bind=fd@"+strconv.Itoa(inheritedAppFD))
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{appFile, debugFile, pw, er}
+	cmd.Env = os.Environ()
+	if debugListener != nil {
+		cmd.Env = append(cmd.Env, debugFDEnv+"="+strconv.Itoa(inheritedDebugFD))
+	}
+	cmd.Env = append(cmd.Env, readyFDEnv+"="+strconv.Itoa(readyFD), parentFDEnv+"="+strconv.Itoa(parentFD))
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		ew.Close()
+		return err
+	}
+	pw.Close()
+	slog.Info("restart: started child", "pid", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := pr.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoffTimeout):
+		err = errors.New("restart: child did not become ready")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ew.Close()
+		return err
+	}
+	exitPipe = ew
+	go cmd.Process.Release()
+	return nil
+}
+
+// childArgs replaces any -bind flag in args with bind.
+func childArgs(args []string, bind string) []string {
+	out := make([]string, 0, len(args)+1)
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimPrefix(args[i], "-")
+		switch {
+		case a == "-bind" || a == "bind":
+			i++
+		case strings.HasPrefix(a, "bind=") || strings.HasPrefix(a, "-bind="):
+		default:
+			out = append(out, args[i])
+		}
+	}
+	return append(out, bind)
+}
+
+// notifyReady tells the parent of a restart that startup has finished.
+func notifyReady() {
+	s := os.Getenv(readyFDEnv)
+	if s == "" {
+		return
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// saveSessions writes the in-memory sessions to sessionFile so that a
+// restart does not log everyone out.
+func saveSessions() {
+	if sessionFile == "" {
+		return
+	}
+	tmp := sessionFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		slog.Error("failed to save sessions", "path", sessionFile, "err", err)
+		return
+	}
+	sessionStore.Lock()
+	err = gob.NewEncoder(f).Encode(sessionStore.store)
+	n := len(sessionStore.store)
+	sessionStore.Unlock()
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, sessionFile)
+	}
+	if err != nil {
+		slog.Error("failed to save sessions", "path", sessionFile, "err", err)
+		return
+	}
+	slog.Info("saved sessions", "path", sessionFile, "sessions", n)
+}
+
+// readSessions reads sessionFile, returning nil if there is none.
+func readSessions() (map[string]*Session, error) {
+	f, err := os.Open(sessionFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	store := make(map[string]*Session)
+	if err := gob.NewDecoder(f).Decode(&store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// loadSessions restores the sessions saved by saveSessions. In the child of
+// a handoff it also merges the parent's final sessions once the parent
+// exits.
+func loadSessions() {
+	if sessionFile == "" {
+		return
+	}
+	store, err := readSessions()
+	if err != nil {
+		slog.Error("failed to load sessions", "path", sessionFile, "err", err)
+	} else if store != nil {
+		sessionStore.Lock()
+		sessionStore.store = store
+		sessionStore.Unlock()
+		slog.Info("loaded sessions", "path", sessionFile, "sessions", len(store))
+	}
+
+	fd, err := strconv.Atoi(os.Getenv(parentFDEnv))
+	if err != nil {
+		return
+	}
+	sessionStore.Lock()
+	sessionStore.changed = make(map[string]bool)
+	sessionStore.Unlock()
+	go func() {
+		f := os.NewFile(uintptr(fd), "parent")
+		io.Copy(io.Discard, f)
+		f.Close()
+		mergeSessions()
+	}()
+}
+
+// mergeSessions takes from sessionFile the sessions that this process has
+// not set since loadSessions, and stops tracking changes.
+func mergeSessions() {
+	store, err := readSessions()
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	changed := sessionStore.changed
+	sessionStore.changed = nil
+	if err != nil {
+		slog.Error("failed to merge sessions", "path", sessionFile, "err", err)
+		return
+	}
+	n := 0
+	for key, s := range store {
+		if !changed[key] {
+			sessionStore.store[key] = s
+			n++
+		}
+	}
+	slog.Info("merged sessions saved by the parent", "path", sessionFile, "sessions", n)
+}
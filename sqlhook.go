@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// hookedDriverName is a MySQL driver that reports every statement to
+// queryHooks. Hooks must be registered before the DB is opened.
+const hookedDriverName = "mysql+hooks"
+
+type queryHook func(ctx context.Context, query string, d time.Duration, err error)
+
+var queryHooks []queryHook
+
+func init() {
+	sql.Register(hookedDriverName, hookDriver{mysql.MySQLDriver{}})
+}
+
+func runQueryHooks(ctx context.Context, query string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		// database/sql retries through a prepared statement, which is
+		// reported on its own.
+		return
+	}
+	d := time.Since(start)
+	for _, h := range queryHooks {
+		h(ctx, query, d, err)
+	}
+}
+
+type hookDriver struct {
+	driver.Driver
+}
+
+func (d hookDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &hookConn{c}, nil
+}
+
+type hookConn struct {
+	driver.Conn
+}
+
+func (c *hookConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *hookConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		s   driver.Stmt
+		err error
+	)
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = pc.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hookStmt{s, query}, nil
+}
+
+func (c *hookConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *hookConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := ec.ExecContext(ctx, query, args)
+	runQueryHooks(ctx, query, start, err)
+	return res, err
+}
+
+func (c *hookConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	runQueryHooks(ctx, query, start, err)
+	return rows, err
+}
+
+func (c *hookConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *hookConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *hookConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *hookConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type hookStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *hookStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var (
+		res driver.Result
+		err error
+	)
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = ec.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(namedValuesToValues(args))
+	}
+	runQueryHooks(ctx, s.query, start, err)
+	return res, err
+}
+
+func (s *hookStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValuesToValues(args))
+	}
+	runQueryHooks(ctx, s.query, start, err)
+	return rows, err
+}
+
+func (s *hookStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValuesToValues(args []driver.NamedValue) []driver.Value {
+	vs := make([]driver.Value, len(args))
+	for i, a := range args {
+		vs[i] = a.Value
+	}
+	return vs
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+)
+
+// Per-user counters for the profile page live in user_stats. They are
+// updated in the same transaction that inserts a post or comment, and
+// rebuilt from scratch by recountUserStats.
+
+type userStats struct {
+	PostCount      int `db:"post_count"`
+	CommentCount   int `db:"comment_count"`
+	CommentedCount int `db:"commented_count"`
+}
+
+const recountUserStatsQuery = "INSERT INTO `user_stats` (`user_id`, `post_count`, `comment_count`, `commented_count`)" +
+	" SELECT u.`id`, COALESCE(p.`n`, 0), COALESCE(c.`n`, 0), COALESCE(r.`n`, 0) FROM `users` u" +
+	" LEFT JOIN (SELECT `user_id`, COUNT(*) AS `n` FROM `posts` GROUP BY `user_id`) p ON p.`user_id` = u.`id`" +
+	" LEFT JOIN (SELECT `user_id`, COUNT(*) AS `n` FROM `comments` GROUP BY `user_id`) c ON c.`user_id` = u.`id`" +
+	" LEFT JOIN (SELECT posts.`user_id`, COUNT(*) AS `n` FROM `comments` INNER JOIN `posts` ON comments.`post_id` = posts.`id`" +
+	" GROUP BY posts.`user_id`) r ON r.`user_id` = u.`id`"
+
+func getUserStats(ctx context.Context, uid int) (userStats, error) {
+	var s userStats
+	err := db.GetContext(ctx, &s, "SELECT `post_count`, `comment_count`, `commented_count` FROM `user_stats` WHERE `user_id` = ?", uid)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return s, err
+}
+
+// insertPost stores p and counts it for its author, returning its ID. place,
+// if not nil, is called with the new ID before the post becomes visible and
+// returns the path of the file it wrote; an error from it cancels the
+// insert. The file is removed if the insert is not committed, as the ID may
+// be handed out again. The author's page is invalidated.
+func insertPost(ctx context.Context, p Post, place func(pid int) (string, error)) (int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
+	result, err := tx.ExecContext(ctx, query, p.UserID, p.Mime, p.Imgdata, p.Body)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO `user_stats` (`user_id`, `post_count`) VALUES (?, 1)"+
+		" ON DUPLICATE KEY UPDATE `post_count` = `post_count` + 1", p.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if place != nil {
+		path, err := place(int(pid))
+		if err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			os.Remove(path)
+			return 0, err
+		}
+	} else if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	invalidateProfiles(ctx, p.UserID)
+	return int(pid), nil
+}
+
+// commentStatsQuery counts a comment by commenter on a post by owner (0 if
+// the post is gone). Both rows are updated in one statement, in user_id
+// order, so that two comments between the same pair of users always lock
+// the rows in the same order and cannot deadlock.
+func commentStatsQuery(commenter, owner int) (string, []any) {
+	type row struct{ uid, comments, commented int }
+	var rows []row
+	switch {
+	case owner == 0:
+		rows = []row{{commenter, 1, 0}}
+	case owner == commenter:
+		rows = []row{{commenter, 1, 1}}
+	case owner < commenter:
+		rows = []row{{owner, 0, 1}, {commenter, 1, 0}}
+	default:
+		rows = []row{{commenter, 1, 0}, {owner, 0, 1}}
+	}
+	query := "INSERT INTO `user_stats` (`user_id`, `comment_count`, `commented_count`) VALUES (?,?,?)"
+	args := []any{rows[0].uid, rows[0].comments, rows[0].commented}
+	for _, r := range rows[1:] {
+		query += ",(?,?,?)"
+		args = append(args, r.uid, r.comments, r.commented)
+	}
+	query += " ON DUPLICATE KEY UPDATE `comment_count` = `comment_count` + VALUES(`comment_count`)," +
+		" `commented_count` = `commented_count` + VALUES(`commented_count`)"
+	return query, args
+}
+
+// insertComment stores c and counts it for its author and for the author of
+// the post, returning its ID. The pages of both are invalidated.
+func insertComment(ctx context.Context, c Comment) (int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`, `created_at`) VALUES (?,?,?,?)"
+	result, err := tx.ExecContext(ctx, query, c.PostID, c.UserID, c.Comment, c.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	cid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	var owner int
+	err = tx.GetContext(ctx, &owner, "SELECT `user_id` FROM `posts` WHERE `id` = ?", c.PostID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	query, args := commentStatsQuery(c.UserID, owner)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	invalidateProfiles(ctx, c.UserID)
+	if owner != 0 && owner != c.UserID {
+		invalidateProfiles(ctx, owner)
+	}
+	return int(cid), nil
+}
+
+// recountUserStats rebuilds every counter from the posts and comments
+// tables.
+func recountUserStats(ctx context.Context) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `user_stats`"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, recountUserStatsQuery); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// Tracing is off unless an exporter is configured (config.TraceExporter):
+//
+//	otlp    OTLP/HTTP, configured by OTEL_EXPORTER_OTLP_*
+//	stdout  JSON spans on stdout
+//	file    JSON spans appended to config.TraceFile
+//
+// Without one, otel's no-op tracer is used and spans cost next to nothing.
+
+const tracerName = "isucon"
+
+var tracer = otel.Tracer(tracerName)
+
+// initTracing installs the tracer provider for exporter and returns a
+// function that flushes buffered spans.
+func initTracing(exporter, file string) (func(context.Context) error, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f io.Writer
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err == nil {
+			exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return nil, errUnknownExporter(exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = tp.Tracer(tracerName)
+	queryHooks = append(queryHooks, traceQuery)
+	return tp.Shutdown, nil
+}
+
+type errUnknownExporter string
+
+func (e errUnknownExporter) Error() string {
+	return "tracing: unknown exporter " + string(e)
+}
+
+// traceQuery records a finished statement as a span of the caller's context.
+func traceQuery(ctx context.Context, query string, d time.Duration, err error) {
+	end := time.Now()
+	_, span := tracer.Start(ctx, "db "+queryOp(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-d)),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.statement", query),
+		))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// traceRender runs render inside a span named after the template.
+func traceRender(ctx context.Context, name string, render func()) {
+	_, span := tracer.Start(ctx, "template "+name)
+	defer span.End()
+	render()
+}
+
+func tracingMiddleware(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		route := routePattern(c)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		ww := mutil.WrapWriter(w)
+		h.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Image uploads are streamed from the multipart body straight into a
+// temporary file in config.UploadDir, and rejected as soon as they exceed
+// config.UploadLimit. Uploads run concurrently; each user may have at most
+// config.UploadsPerUser in flight.
+
+const uploadFieldLimit = 64 * 1024 // body, csrf_token and other text fields
+
+// uploadRejection is why an upload was refused. It labels
+// isucon_upload_rejections_total.
+type uploadRejection string
+
+const (
+	rejectCSRF     uploadRejection = "csrf"
+	rejectNoFile   uploadRejection = "no_file"
+	rejectMime     uploadRejection = "mime"
+	rejectTooLarge uploadRejection = "too_large"
+)
+
+func (r uploadRejection) Error() string { return "upload rejected: " + string(r) }
+
+var (
+	uploadsM        sync.Mutex
+	uploadsInFlight = make(map[int]int)
+)
+
+// acquireUpload reserves one of uid's upload slots.
+func acquireUpload(uid int) bool {
+	uploadsM.Lock()
+	defer uploadsM.Unlock()
+	if uploadsInFlight[uid] >= config.UploadsPerUser {
+		return false
+	}
+	uploadsInFlight[uid]++
+	return true
+}
+
+func releaseUpload(uid int) {
+	uploadsM.Lock()
+	defer uploadsM.Unlock()
+	if uploadsInFlight[uid]--; uploadsInFlight[uid] <= 0 {
+		delete(uploadsInFlight, uid)
+	}
+}
+
+type upload struct {
+	fields map[string]string
+	file   *os.File // temporary; removed by Close unless renamed
+	size   int64
+	mime   string
+}
+
+// Close removes the temporary file if it is still there.
+func (u *upload) Close() {
+	if u.file != nil {
+		u.file.Close()
+		os.Remove(u.file.Name())
+	}
+}
+
+func (u *upload) FormValue(name string) string {
+	return u.fields[name]
+}
+
+// imageMime maps the Content-Type sent with an image to the stored mime
+// type, or "" for unsupported types.
+func imageMime(contentType string) string {
+	// 投稿のContent-Typeからファイルのタイプを決定する
+	switch {
+	case strings.Contains(contentType, "jpeg"):
+		return "image/jpeg"
+	case strings.Contains(contentType, "png"):
+		return "image/png"
+	case strings.Contains(contentType, "gif"):
+		return "image/gif"
+	}
+	return ""
+}
+
+// readUpload reads the post form of r, streaming the "file" part to disk.
+// The returned upload must be closed, also when the error is an
+// uploadRejection. After a file of the wrong type the remaining fields are
+// still read, so that the CSRF token can be checked; a file that is too
+// large ends the read.
+func readUpload(w http.ResponseWriter, r *http.Request) (*upload, error) {
+	u := &upload{fields: make(map[string]string)}
+	var rejected error
+	// Bound the whole body, in case a client sends endless text fields.
+	r.Body = http.MaxBytesReader(w, r.Body, config.UploadLimit+16*uploadFieldLimit)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return u, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return u, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" && u.file == nil && rejected == nil {
+			err = u.readFile(part)
+			if err == rejectMime {
+				rejected, err = err, nil
+			}
+		} else {
+			var b []byte
+			b, err = io.ReadAll(io.LimitReader(part, uploadFieldLimit))
+			u.fields[part.FormName()] = string(b)
+		}
+		part.Close()
+		if err != nil {
+			return u, err
+		}
+	}
+	if rejected != nil {
+		return u, rejected
+	}
+	if u.file == nil {
+		return u, rejectNoFile
+	}
+	return u, nil
+}
+
+func (u *upload) readFile(part *multipart.Part) error {
+	u.mime = imageMime(part.Header.Get("Content-Type"))
+	if u.mime == "" {
+		return rejectMime
+	}
+	f, err := ioutil.TempFile(config.UploadDir, "img-")
+	if err != nil {
+		return err
+	}
+	u.file = f
+	u.size, err = io.Copy(f, io.LimitReader(part, config.UploadLimit+1))
+	if err != nil {
+		return err
+	}
+	if u.size > config.UploadLimit {
+		return rejectTooLarge
+	}
+	return f.Close()
+}
+
+// isUploadRejection reports whether err is an uploadRejection, and which.
+func isUploadRejection(err error) (uploadRejection, bool) {
+	var rej uploadRejection
+	ok := errors.As(err, &rej)
+	return rej, ok
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users are cached in memory by ID. Every mutation goes through the
+// functions below, which write to the DB first and then to the cache, so
+// that the cache never holds a state the DB does not. Misses fall back to
+// the DB.
+
+type userCache struct {
+	sync.RWMutex
+	byID map[int]User
+}
+
+var userStore = &userCache{byID: make(map[int]User)}
+
+func (c *userCache) get(uid int) (User, bool) {
+	c.RLock()
+	u, ok := c.byID[uid]
+	c.RUnlock()
+	return u, ok
+}
+
+func (c *userCache) put(u User) {
+	c.Lock()
+	c.byID[u.ID] = u
+	c.Unlock()
+}
+
+func (c *userCache) remove(uid int) {
+	c.Lock()
+	delete(c.byID, uid)
+	c.Unlock()
+}
+
+func (c *userCache) replace(users []User) {
+	byID := make(map[int]User, len(users))
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	c.Lock()
+	c.byID = byID
+	c.Unlock()
+}
+
+func (c *userCache) len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.byID)
+}
+
+// usersReset reloads the whole cache from the DB.
+func usersReset(ctx context.Context) error {
+	users := []User{}
+	err := db.SelectContext(ctx, &users, "SELECT * FROM users")
+	if err != nil {
+		return err
+	}
+	userStore.replace(users)
+	usersLoaded.Store(true)
+	return nil
+}
+
+// getUser returns the user with uid, or the zero User if there is none.
+func getUser(ctx context.Context, uid int) User {
+	if u, ok := userStore.get(uid); ok || uid == 0 {
+		return u
+	}
+	u := User{}
+	err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `id` = ?", uid)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			ctxLogger(ctx).Error("failed to get user", "user_id", uid, "err", err)
+		}
+		return User{}
+	}
+	userStore.put(u)
+	return u
+}
+
+// prefetchUsers caches the users among uids that are not cached yet, with
+// one query.
+func prefetchUsers(ctx context.Context, uids []int) {
+	seen := make(map[int]bool, len(uids))
+	var args []interface{}
+	for _, uid := range uids {
+		if seen[uid] || uid == 0 {
+			continue
+		}
+		seen[uid] = true
+		if _, ok := userStore.get(uid); !ok {
+			args = append(args, uid)
+		}
+	}
+	if len(args) == 0 {
+		return
+	}
+	users := []User{}
+	query := "SELECT * FROM `users` WHERE `id` IN (" + strings.TrimSuffix(strings.Repeat("?,", len(args)), ",") + ")"
+	if err := db.SelectContext(ctx, &users, query, args...); err != nil {
+		ctxLogger(ctx).Error("failed to select users", "users", len(args), "err", err)
+		return
+	}
+	for _, u := range users {
+		userStore.put(u)
+	}
+}
+
+// getUserByName looks accountName up in the DB, banned users included.
+func getUserByName(ctx context.Context, accountName string) (User, error) {
+	u := User{}
+	err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `account_name` = ?", accountName)
+	return u, err
+}
+
+var errUserExists = errors.New("account name is already taken")
+
+// createUser inserts a local user.
+func createUser(ctx context.Context, accountName, password string, authority int) (User, error) {
+	exists := 0
+	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
+	db.GetContext(ctx, &exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	if exists == 1 {
+		return User{}, errUserExists
+	}
+	return insertUser(ctx, User{
+		AccountName: accountName,
+		Passhash:    calculatePasshash(accountName, password),
+		Authority:   authority,
+	})
+}
+
+// insertUser stores u and returns it with its new ID.
+func insertUser(ctx context.Context, u User) (User, error) {
+	query := "INSERT INTO `users` (`account_name`, `passhash`, `authority`) VALUES (?,?,?)"
+	result, err := db.ExecContext(ctx, query, u.AccountName, u.Passhash, u.Authority)
+	if err != nil {
+		return User{}, err
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	u.ID = int(uid)
+	u.CreatedAt = time.Now()
+	userStore.put(u)
+	publishInvalidation(ctx, invalidateUser, u.ID)
+	return u, nil
+}
+
+// updateUser saves the mutable fields of u: password hash, authority and
+// ban flag.
+func updateUser(ctx context.Context, u User) error {
+	query := "UPDATE `users` SET `passhash` = ?, `authority` = ?, `del_flg` = ? WHERE `id` = ?"
+	if _, err := db.ExecContext(ctx, query, u.Passhash, u.Authority, u.DelFlg, u.ID); err != nil {
+		return err
+	}
+	userStore.put(u)
+	profiles.remove(u.ID)
+	publishInvalidation(ctx, invalidateUser, u.ID)
+	return nil
+}
+
+// setUserBan sets del_flg of uid to ban (0 or 1).
+func setUserBan(ctx context.Context, uid, ban int) error {
+	if _, err := db.ExecContext(ctx, "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?", ban, uid); err != nil {
+		return err
+	}
+	// Reload rather than patch, so a user missing from the cache is not
+	// cached as a zero User with only the flag set.
+	u := User{}
+	if err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `id` = ?", uid); err != nil {
+		return err
+	}
+	userStore.put(u)
+	profiles.remove(uid)
+	publishInvalidation(ctx, invalidateUser, uid)
+	return nil
+}
+
+// setUserLocale saves the UI language uid has chosen.
+func setUserLocale(ctx context.Context, uid int, locale string) error {
+	if _, err := db.ExecContext(ctx, "UPDATE `users` SET `locale` = ? WHERE `id` = ?", locale, uid); err != nil {
+		return err
+	}
+	if u, ok := userStore.get(uid); ok {
+		u.Locale = locale
+		userStore.put(u)
+	}
+	publishInvalidation(ctx, invalidateUser, uid)
+	return nil
+}
+
+// setPassword replaces the password of accountName.
+func setPassword(ctx context.Context, accountName, password string) error {
+	u, err := getUserByName(ctx, accountName)
+	if err != nil {
+		return err
+	}
+	u.Passhash = calculatePasshash(accountName, password)
+	return updateUser(ctx, u)
+}
+
+// checkUserCache compares the cache with the DB and describes every
+// difference. An empty result means they agree.
+func checkUserCache(ctx context.Context) ([]string, error) {
+	users := []User{}
+	if err := db.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
+		return nil, err
+	}
+
+	userStore.RLock()
+	cached := make(map[int]User, len(userStore.byID))
+	for id, u := range userStore.byID {
+		cached[id] = u
+	}
+	userStore.RUnlock()
+
+	var diffs []string
+	for _, u := range users {
+		c, ok := cached[u.ID]
+		delete(cached, u.ID)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("user %d (%s): missing from cache", u.ID, u.AccountName))
+		case c.AccountName != u.AccountName || c.Passhash != u.Passhash ||
+			c.Authority != u.Authority || c.DelFlg != u.DelFlg:
+			diffs = append(diffs, fmt.Sprintf("user %d (%s): cache has account_name=%s authority=%d del_flg=%d passhash_match=%t, db has authority=%d del_flg=%d",
+				u.ID, u.AccountName, c.AccountName, c.Authority, c.DelFlg, c.Passhash == u.Passhash, u.Authority, u.DelFlg))
+		}
+	}
+	for id, c := range cached {
+		diffs = append(diffs, fmt.Sprintf("user %d (%s): in cache but not in db", id, c.AccountName))
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// getCheckUsers is served on the debug listener for check-users. It
+// answers 409 when the cache and DB disagree.
+func getCheckUsers(w http.ResponseWriter, r *http.Request) {
+	diffs, err := checkUserCache(r.Context())
+	if err != nil {
+		reqLogger(r).Error("failed to check user cache", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(diffs) > 0 {
+		w.WriteHeader(http.StatusConflict)
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(w, d)
+	}
+}
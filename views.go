@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// The views are compiled from main/*.qtpl, so there is nothing to parse at
+// run time and the binary does not read templates from the working
+// directory.
+//
+// A build with -tags dev renders html/template copies of the views in
+// templates/ instead (see views_dev.go). They are embedded in the binary
+// and, with -dev-source, read from that source tree and parsed again when
+// they change, so an edit shows up on the next page load without a
+// rebuild. Keep the two in step: the copies are only for trying out
+// changes, which then go into main/*.qtpl.
+
+//go:generate sh -c "cd main && qtc && mv *.qtpl.go .."
+
+// viewSet renders the pages and post lists.
+type viewSet interface {
+	// writeLayout renders p, the page named name, inside the layout.
+	writeLayout(w io.Writer, name string, me User, loc locale, csrfToken string, p Page)
+	writePostList(w io.Writer, loc locale, posts []Post)
+	// watch reloads the views from dir until ctx is done.
+	watch(ctx context.Context, dir string)
+}
+
+var views viewSet = compiledViews{}
+
+// compiledViews are the quicktemplate views.
+type compiledViews struct{}
+
+func (compiledViews) writeLayout(w io.Writer, name string, me User, loc locale, csrfToken string, p Page) {
+	WriteLayout(w, me, loc, csrfToken, p)
+}
+
+func (compiledViews) writePostList(w io.Writer, loc locale, posts []Post) {
+	WritePostList(w, loc, posts)
+}
+
+func (compiledViews) watch(ctx context.Context, dir string) {
+	slog.Warn("template reload needs a build with -tags dev", "dir", dir)
+}
@@ -0,0 +1,180 @@
+//go:build dev
+
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+const templateWatchInterval = 500 * time.Millisecond
+
+// devPages are the pages rendered by devViews, each from layout.html,
+// posts.html and <name>.html.
+var devPages = []string{"index", "post", "user", "banned", "login", "register"}
+
+// devPageData is what the page templates are executed with.
+type devPageData struct {
+	Me        User
+	Loc       locale
+	CSRFToken string
+	Page      Page
+}
+
+// devPost is what the "post" template is executed with.
+type devPost struct {
+	*Post
+	Loc locale
+}
+
+var devFuncs = template.FuncMap{
+	"imageURL": imageURL,
+	"locales":  func() []locale { return locales },
+	"post":     func(l locale, p *Post) devPost { return devPost{Post: p, Loc: l} },
+	"raw":      func(s string) template.HTML { return template.HTML(s) },
+	"timeago":  func(l locale) template.JS { return template.JS(timeagoJSON[l]) },
+}
+
+// devViews are the html/template copies of the views, parsed from
+// templates/ and swapped for a new set when those change.
+type devViews struct {
+	sync.RWMutex
+	pages map[string]*template.Template
+	posts *template.Template
+}
+
+func init() {
+	v := &devViews{}
+	sub, _ := fs.Sub(templateFS, "templates")
+	if err := v.load(sub); err != nil {
+		panic(err)
+	}
+	views = v
+}
+
+// load parses the templates in fsys and, if they all parse, replaces the
+// current ones.
+func (v *devViews) load(fsys fs.FS) error {
+	posts, err := template.New("posts.html").Funcs(devFuncs).ParseFS(fsys, "posts.html")
+	if err != nil {
+		return err
+	}
+	pages := make(map[string]*template.Template, len(devPages))
+	for _, name := range devPages {
+		t, err := template.New("layout.html").Funcs(devFuncs).ParseFS(fsys, "layout.html", "posts.html", name+".html")
+		if err != nil {
+			return err
+		}
+		pages[name] = t
+	}
+	v.Lock()
+	v.pages, v.posts = pages, posts
+	v.Unlock()
+	return nil
+}
+
+func (v *devViews) writeLayout(w io.Writer, name string, me User, loc locale, csrfToken string, p Page) {
+	v.RLock()
+	t := v.pages[name]
+	v.RUnlock()
+	if t == nil {
+		slog.Error("no template for page", "page", name)
+		return
+	}
+	if err := t.Execute(w, devPageData{Me: me, Loc: loc, CSRFToken: csrfToken, Page: p}); err != nil {
+		slog.Error("failed to render page", "page", name, "err", err)
+	}
+}
+
+func (v *devViews) writePostList(w io.Writer, loc locale, posts []Post) {
+	v.RLock()
+	t := v.posts
+	v.RUnlock()
+	data := make([]devPost, len(posts))
+	for i := range posts {
+		data[i] = devPost{Post: &posts[i], Loc: loc}
+	}
+	if err := t.ExecuteTemplate(w, "posts", data); err != nil {
+		slog.Error("failed to render posts", "err", err)
+	}
+}
+
+// watch polls dir/templates/*.html until ctx is done and parses them again
+// when one changes. Templates that do not parse are logged and the current
+// ones stay in use.
+func (v *devViews) watch(ctx context.Context, dir string) {
+	dir = filepath.Join(dir, "templates")
+	last, err := templateModTimes(dir)
+	if err != nil {
+		slog.Error("template reload disabled", "dir", dir, "err", err)
+		return
+	}
+	if err := v.load(os.DirFS(dir)); err != nil {
+		slog.Error("failed to parse templates; serving the embedded ones", "dir", dir, "err", err)
+	}
+	slog.Info("watching templates", "dir", dir)
+	t := time.NewTicker(templateWatchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cur, err := templateModTimes(dir)
+		if err != nil || sameModTimes(last, cur) {
+			continue
+		}
+		last = cur
+		if err := v.load(os.DirFS(dir)); err != nil {
+			slog.Error("failed to parse templates; still serving the old ones", "err", err)
+			continue
+		}
+		profiles.reset()
+		renderIndexPosts(ctx)
+		slog.Info("templates reloaded")
+	}
+}
+
+func templateModTimes(dir string) (map[string]time.Time, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no templates found")
+	}
+	m := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		m[f] = fi.ModTime()
+	}
+	return m, nil
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, t := range a {
+		if !b[f].Equal(t) {
+			return false
+		}
+	}
+	return true
+}